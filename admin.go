@@ -0,0 +1,193 @@
+//
+//  The administrative API.
+//
+//  These end-points allow the server to be managed at runtime, rather
+// than by editing files on the server.  They are only available if an
+// admin-token is configured, via the `-admin-token` flag, and callers
+// must supply that token:
+//
+//    Authorization: Bearer $token
+//
+//  The field-blacklists may be managed via:
+//
+//    GET    /admin/blacklist/{field}
+//    POST   /admin/blacklist/{field}   {"pattern":"..."}
+//    DELETE /admin/blacklist/{field}?pattern=...
+//
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// The token which must be presented to use the admin API.
+//
+// If this is empty the admin API is disabled.
+//
+var adminToken string
+
+//
+// adminAuth is middleware which ensures the caller supplied our
+// admin-token.
+//
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		if len(adminToken) == 0 {
+			http.Error(res, "The admin API is disabled", http.StatusForbidden)
+			return
+		}
+
+		auth := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(res, "Invalid admin-token", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+//
+// adminPattern returns the pattern the caller supplied, either as a
+// query-parameter or within a JSON body.
+//
+func adminPattern(req *http.Request) (string, error) {
+
+	pattern := req.URL.Query().Get("pattern")
+
+	if len(pattern) == 0 && req.Body != nil {
+		var input struct {
+			Pattern string
+		}
+		err := json.NewDecoder(req.Body).Decode(&input)
+		if err != nil {
+			return "", err
+		}
+		pattern = input.Pattern
+	}
+
+	if len(pattern) == 0 {
+		return "", errors.New("Missing pattern")
+	}
+
+	//
+	// Patterns are stored one per line, so a pattern containing a
+	// newline would become several patterns we never validated.
+	//
+	if strings.ContainsAny(pattern, "\r\n") {
+		return "", errors.New("Patterns may not contain newlines")
+	}
+	return pattern, nil
+}
+
+//
+// AdminBlacklistHandler is a HTTP-handler which lists, adds, and removes
+// the blacklisted patterns for a field.
+//
+// The patterns for the field are returned after any change.
+//
+func AdminBlacklistHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+			// Don't spam stdout when running test-cases.
+			if flag.Lookup("test.v") == nil {
+				fmt.Printf("WARNING - Error returned from /admin/blacklist handler - %s\n", err.Error())
+			}
+		}
+	}()
+
+	//
+	// Ensure the field is one we know about.
+	//
+	field := strings.ToLower(mux.Vars(req)["field"])
+	if !blacklistFieldNames()[field] {
+		err = fmt.Errorf("Unknown field '%s'", field)
+		status = http.StatusNotFound
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		// Nop
+
+	case "POST":
+		var pattern string
+		pattern, err = adminPattern(req)
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+
+		//
+		// Ensure the pattern is valid before we store it.
+		//
+		_, err = regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+
+		err = addBlacklistPattern(field, pattern)
+		if err != nil {
+			status = http.StatusInternalServerError
+			return
+		}
+
+	case "DELETE":
+		var pattern string
+		pattern, err = adminPattern(req)
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+
+		err = removeBlacklistPattern(field, pattern)
+		if err != nil {
+			status = http.StatusInternalServerError
+			return
+		}
+
+	default:
+		err = errors.New("Must be called via HTTP-GET, POST, or DELETE")
+		status = http.StatusMethodNotAllowed
+		return
+	}
+
+	//
+	// Return the current patterns.
+	//
+	patterns := []string{}
+	if list, ok := blacklistedFields().fields[field]; ok {
+		patterns = list.patterns
+	}
+
+	jsonString, err := json.Marshal(map[string]interface{}{
+		"field":    field,
+		"patterns": patterns,
+	})
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(res, "%s", jsonString)
+}
@@ -0,0 +1,223 @@
+//
+// Test for our admin API.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//
+// Make a request to our router, with the given token.
+//
+func adminRequest(t *testing.T, method string, url string, body string, token string) *httptest.ResponseRecorder {
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+//
+// Test that the admin API requires the correct token.
+//
+func TestAdminAuth(t *testing.T) {
+
+	adminToken = ""
+	rr := adminRequest(t, "GET", "/admin/blacklist/name", "", "secret")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+
+	rr = adminRequest(t, "GET", "/admin/blacklist/name", "", "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	rr = adminRequest(t, "GET", "/admin/blacklist/name", "", "guess")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	//
+	// The token must be given as a bearer token.
+	//
+	req, _ := http.NewRequest("GET", "/admin/blacklist/name", nil)
+	req.Header.Set("Authorization", "secret")
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status-code without a scheme: %v", rr.Code)
+	}
+
+	rr = adminRequest(t, "GET", "/admin/blacklist/name", "", "secret")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	rr = adminRequest(t, "GET", "/admin/blacklist/bogus", "", "secret")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+}
+
+//
+// Test that we can add, and remove, patterns.
+//
+func TestAdminBlacklist(t *testing.T) {
+
+	adminToken = "secret"
+	dir := t.TempDir()
+
+	saved := blacklistDirectories
+	blacklistDirectories = []string{dir}
+	reloadBlacklists()
+	defer func() {
+		adminToken = ""
+		blacklistDirectories = saved
+		reloadBlacklists()
+	}()
+
+	//
+	// Invalid patterns are rejected.
+	//
+	rr := adminRequest(t, "POST", "/admin/blacklist/name", "{\"pattern\":\"broken(\"}", "secret")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	//
+	// Valid ones take effect immediately.
+	//
+	rr = adminRequest(t, "POST", "/admin/blacklist/name", "{\"pattern\":\"^steve$\"}", "secret")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "\"patterns\":[\"^steve$\"]") {
+		t.Errorf("Unexpected body: %s", rr.Body.String())
+	}
+
+	result, _ := checkBlacklistedFields(Submission{Name: "Steve"})
+	if result != Spam {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "name"))
+	if string(data) != "^steve$\n" {
+		t.Errorf("Unexpected file contents: '%s'", data)
+	}
+
+	//
+	// Now remove it.
+	//
+	rr = adminRequest(t, "DELETE", "/admin/blacklist/name?pattern=%5Esteve%24", "", "secret")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "\"patterns\":[]") {
+		t.Errorf("Unexpected body: %s", rr.Body.String())
+	}
+
+	result, _ = checkBlacklistedFields(Submission{Name: "Steve"})
+	if result != Undecided {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+}
+
+//
+// Test that patterns containing newlines are rejected.
+//
+func TestAdminBlacklistNewlines(t *testing.T) {
+
+	adminToken = "secret"
+	dir := t.TempDir()
+
+	saved := blacklistDirectories
+	blacklistDirectories = []string{dir}
+	reloadBlacklists()
+	defer func() {
+		adminToken = ""
+		blacklistDirectories = saved
+		reloadBlacklists()
+	}()
+
+	for _, body := range []string{`{"pattern":"^steve$\n.*"}`, `{"pattern":"^steve$\r.*"}`} {
+		rr := adminRequest(t, "POST", "/admin/blacklist/name", body, "secret")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status-code for %s: %v", body, rr.Code)
+		}
+	}
+
+	rr := adminRequest(t, "DELETE", "/admin/blacklist/name?pattern=a%0Ab", "", "secret")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "name")); !os.IsNotExist(err) {
+		t.Errorf("A pattern was written")
+	}
+}
+
+//
+// Test that concurrent changes don't lose one another.
+//
+func TestAdminBlacklistConcurrent(t *testing.T) {
+
+	dir := t.TempDir()
+
+	saved := blacklistDirectories
+	blacklistDirectories = []string{dir}
+	defer func() {
+		blacklistDirectories = saved
+		reloadBlacklists()
+	}()
+
+	for i := 0; i < 20; i++ {
+		err := addBlacklistPattern("name", fmt.Sprintf("^spammer%d$", i))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+
+	//
+	// Remove half of the patterns, concurrently.
+	//
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i += 2 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			removeBlacklistPattern("name", fmt.Sprintf("^spammer%d$", i))
+		}(i)
+	}
+	wg.Wait()
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "name"))
+
+	var expected []string
+	for i := 1; i < 20; i += 2 {
+		expected = append(expected, fmt.Sprintf("^spammer%d$", i))
+	}
+	if string(data) != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("Unexpected file contents: '%s'", data)
+	}
+}
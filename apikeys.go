@@ -0,0 +1,271 @@
+//
+//  Per-site API keys.
+//
+//  By default anybody may submit comments for any site, and fetch the
+// statistics of any site.  If the `-require-api-key` flag is given then
+// requests to `/`, `/batch`, `/classify`, and `/stats` must include the
+// API key of the site they refer to:
+//
+//    X-API-Key: $key
+//
+//  Keys are issued via the admin-token protected end-point:
+//
+//    POST /sites/{site}/keys
+//
+//  They're stored in redis, if it is available, beneath the key
+// `api-key-$key`.  Otherwise they're stored in a file with one key per
+// line, followed by the site it is for:
+//
+//    0123456789abcdef example.com
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+)
+
+//
+// Are API keys required?
+//
+// This may be changed via the `-require-api-key` flag.
+//
+var apiKeysRequired = false
+
+//
+// The file we store API keys within, if redis is not available.
+//
+// This may be changed via the `-api-key-file` flag.
+//
+var apiKeyFile = "./api-keys"
+
+//
+// The keys loaded from our file, mapping each to the siteKey of the
+// site it was issued for.
+//
+var (
+	fileKeys     = make(map[string]string)
+	fileKeysLock sync.RWMutex
+)
+
+//
+// The type of the context-key beneath which we store the site of the
+// API key a request was made with.
+//
+type apiSiteContextKey struct{}
+
+//
+// The paths which require an API key.
+//
+var apiKeyPaths = map[string]bool{
+	"":          true,
+	"/batch":    true,
+	"/classify": true,
+	"/stats":    true,
+}
+
+//
+// loadAPIKeys reads the keys from our file, if it exists.
+//
+func loadAPIKeys() error {
+
+	keys := make(map[string]string)
+
+	file, err := os.Open(apiKeyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		line := 0
+		for scanner.Scan() {
+			line++
+
+			text := strings.TrimSpace(scanner.Text())
+			if len(text) == 0 || strings.HasPrefix(text, "#") {
+				continue
+			}
+
+			fields := strings.Fields(text)
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expected a key and a site", apiKeyFile, line)
+			}
+			keys[fields[0]] = siteKey(fields[1])
+		}
+		if err = scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	fileKeysLock.Lock()
+	fileKeys = keys
+	fileKeysLock.Unlock()
+	return nil
+}
+
+//
+// apiKeySite returns the siteKey of the site the given key was issued
+// for, or "" if the key is unknown.
+//
+func apiKeySite(key string) (string, error) {
+
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	if redisHandle != nil {
+		site, err := redisHandle.Get(fmt.Sprintf("api-key-%s", key)).Result()
+		if err == redis.Nil {
+			return "", nil
+		}
+		return site, err
+	}
+
+	fileKeysLock.RLock()
+	defer fileKeysLock.RUnlock()
+	return fileKeys[key], nil
+}
+
+//
+// issueAPIKey creates, and stores, a new key for the given site.
+//
+func issueAPIKey(site string) (string, error) {
+
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(buf)
+
+	if redisHandle != nil {
+		err = redisHandle.Set(fmt.Sprintf("api-key-%s", key), siteKey(site), 0).Err()
+		return key, err
+	}
+
+	fileKeysLock.Lock()
+	defer fileKeysLock.Unlock()
+
+	file, err := os.OpenFile(apiKeyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s %s\n", key, siteKey(site))
+	if err != nil {
+		return "", err
+	}
+
+	fileKeys[key] = siteKey(site)
+	return key, nil
+}
+
+//
+// apiKeyAuth is middleware which ensures the caller supplied a valid
+// API key, if they're required, and records the site it is for in the
+// context of the request.
+//
+// The handlers are responsible for ensuring that site matches the one
+// in the submission, via checkAPIKeySite.
+//
+func apiKeyAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		if !apiKeysRequired || !apiKeyPaths[strings.TrimRight(req.URL.Path, "/")] {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		site, err := apiKeySite(req.Header.Get("X-API-Key"))
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(site) == 0 {
+			http.Error(res, "Missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), apiSiteContextKey{}, site)
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+//
+// checkAPIKeySite returns an error if the request was made with an API
+// key which was not issued for the given site.
+//
+func checkAPIKeySite(ctx context.Context, site string) error {
+
+	allowed, ok := ctx.Value(apiSiteContextKey{}).(string)
+	if !ok {
+		return nil
+	}
+	if allowed != siteKey(site) {
+		return fmt.Errorf("API key is not valid for site '%s'", site)
+	}
+	return nil
+}
+
+//
+// SiteKeyHandler is a HTTP-handler which issues a new API key for a
+// site.
+//
+func SiteKeyHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+			// Don't spam stdout when running test-cases.
+			if flag.Lookup("test.v") == nil {
+				fmt.Printf("WARNING - Error returned from /sites handler - %s\n", err.Error())
+			}
+		}
+	}()
+
+	if req.Method != "POST" {
+		err = errors.New("Must be called via HTTP-POST")
+		status = http.StatusMethodNotAllowed
+		return
+	}
+
+	site := mux.Vars(req)["site"]
+
+	key, err := issueAPIKey(site)
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	jsonString, err := json.Marshal(map[string]string{
+		"site": site,
+		"key":  key,
+	})
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(res, "%s", jsonString)
+}
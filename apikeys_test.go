@@ -0,0 +1,109 @@
+//
+// Test for our per-site API keys.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// Make a request to our router, with the given API key.
+//
+func apiKeyRequest(t *testing.T, url string, body string, key string) *httptest.ResponseRecorder {
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) > 0 {
+		req.Header.Set("X-API-Key", key)
+	}
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+//
+// Test that keys are issued, and enforced.
+//
+func TestAPIKeys(t *testing.T) {
+
+	saved := apiKeyFile
+	apiKeyFile = filepath.Join(t.TempDir(), "api-keys")
+	loadAPIKeys()
+
+	adminToken = "secret"
+	apiKeysRequired = true
+
+	defer func() {
+		apiKeyFile = saved
+		loadAPIKeys()
+		adminToken = ""
+		apiKeysRequired = false
+	}()
+
+	//
+	// Issue a key.
+	//
+	rr := adminRequest(t, "POST", "/sites/example.com/keys", "", "secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", rr.Code)
+	}
+
+	var issued map[string]string
+	err := json.Unmarshal(rr.Body.Bytes(), &issued)
+	if err != nil || len(issued["key"]) == 0 {
+		t.Fatalf("Unexpected body: %s", rr.Body.String())
+	}
+	key := issued["key"]
+
+	//
+	// The key survives a reload.
+	//
+	loadAPIKeys()
+
+	stats := "{\"site\":\"example.com\"}"
+	other := "{\"site\":\"example.org\"}"
+
+	if rr = apiKeyRequest(t, "/stats", stats, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status-code without a key: %v", rr.Code)
+	}
+	if rr = apiKeyRequest(t, "/stats", stats, "bogus"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status-code with a bogus key: %v", rr.Code)
+	}
+	if rr = apiKeyRequest(t, "/stats/", other, key); rr.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status-code for another site: %v", rr.Code)
+	}
+	if rr = apiKeyRequest(t, "/stats", stats, key); rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+	if rr = apiKeyRequest(t, "/classify", "{\"site\":\"example.org\",\"train\":\"spam\"}", key); rr.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status-code for training another site: %v", rr.Code)
+	}
+
+	//
+	// Batches report the mismatch per-submission.
+	//
+	rr = apiKeyRequest(t, "/batch", other, key)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "not valid for site") {
+		t.Errorf("Unexpected response for a batch: %v %s", rr.Code, rr.Body.String())
+	}
+
+	//
+	// Other end-points are unaffected.
+	//
+	req, _ := http.NewRequest("GET", "/plugins", nil)
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code for the plugin-list: %v", rr.Code)
+	}
+}
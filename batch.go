@@ -0,0 +1,258 @@
+//
+//  Test many submissions in a single request.
+//
+//  The body of a request to `/batch` is either a JSON array of
+// submissions, or a stream of newline-delimited JSON submissions.
+//
+//  Each submission is tested exactly as if it had been posted to `/`,
+// with a bounded number being tested concurrently, and the results are
+// streamed back as newline-delimited JSON in the same order as the
+// input.
+//
+//  Streaming results whilst still reading the body requires full-duplex
+// support from the server.  Where that isn't available we read the
+// whole body before testing any of it.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"unicode"
+)
+
+//
+// The number of submissions in a batch we'll test concurrently.
+//
+// This may be changed via the `-batch-workers` flag.
+//
+var batchWorkers = 8
+
+//
+// batchDecoder reads submissions from either a JSON array, or a stream
+// of JSON objects.
+//
+type batchDecoder struct {
+	decoder *json.Decoder
+	array   bool
+}
+
+//
+// newBatchDecoder looks at the start of the given body to determine
+// which format it is in.
+//
+func newBatchDecoder(body io.Reader) (*batchDecoder, error) {
+
+	reader := bufio.NewReader(body)
+
+	//
+	// Skip any leading whitespace, and peek at the first character.
+	//
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return nil, err
+		}
+		if !unicode.IsSpace(r) {
+			reader.UnreadRune()
+			break
+		}
+	}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &batchDecoder{decoder: json.NewDecoder(reader)}
+
+	if first[0] == '[' {
+		ret.array = true
+
+		// Consume the opening bracket.
+		if _, err := ret.decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+//
+// next decodes the next submission, returning io.EOF when there are
+// no more.
+//
+func (b *batchDecoder) next() (Submission, error) {
+	var input Submission
+
+	if b.array && !b.decoder.More() {
+		return input, io.EOF
+	}
+
+	err := b.decoder.Decode(&input)
+	return input, err
+}
+
+//
+// BatchHandler is a HTTP-handler which tests multiple submissions for
+// SPAM, streaming a result for each.
+//
+func BatchHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+			// Don't spam stdout when running test-cases.
+			if flag.Lookup("test.v") == nil {
+				fmt.Printf("WARNING - Error returned from /batch handler - %s\n", err.Error())
+			}
+		}
+	}()
+
+	//
+	// Ensure this was a POST-request
+	//
+	if req.Method != "POST" {
+		err = errors.New("Must be called via HTTP-POST")
+		status = http.StatusInternalServerError
+		return
+	}
+
+	//
+	// We'll be writing results whilst still reading the body, if
+	// we can, otherwise we must read it all first, since the server
+	// may close it once we start writing.
+	//
+	var body io.Reader = req.Body
+	if http.NewResponseController(res).EnableFullDuplex() != nil {
+		var data []byte
+		data, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+		body = bytes.NewReader(data)
+	}
+
+	//
+	// Work out what kind of body we have.
+	//
+	decoder, err := newBatchDecoder(body)
+	if err == io.EOF {
+		err = errors.New("Empty batch")
+		status = http.StatusBadRequest
+		return
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	//
+	// Each submission we read has a channel which will receive the
+	// JSON result for it.  These are queued in the order we read
+	// them, which ensures our output is in the same order.
+	//
+	// The size of the queue limits how far ahead of the output the
+	// reading may get.
+	//
+	size := batchWorkers
+	if size < 1 {
+		size = 1
+	}
+	queue := make(chan chan []byte, size)
+
+	//
+	// Limit the number of submissions being tested concurrently.
+	//
+	workers := make(chan bool, size)
+
+	go func() {
+		defer close(queue)
+
+		for {
+			input, err := decoder.next()
+			if err == io.EOF {
+				return
+			}
+
+			result := make(chan []byte, 1)
+			queue <- result
+
+			//
+			// If we failed to decode then report that and stop,
+			// since we cannot continue after bogus JSON.
+			//
+			if err != nil {
+				result <- batchError(err)
+				return
+			}
+
+			workers <- true
+			go func(input Submission) {
+				defer func() { <-workers }()
+				result <- batchResult(req, input)
+			}(input)
+		}
+	}()
+
+	//
+	// Send the results as they become available.
+	//
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := res.(http.Flusher)
+
+	for result := range queue {
+		fmt.Fprintf(res, "%s\n", <-result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+//
+// batchResult tests a single submission from a batch, and returns the
+// JSON-encoded result.
+//
+func batchResult(req *http.Request, input Submission) []byte {
+
+	if verbose {
+		dumpSubmission(input)
+	}
+
+	err := checkAPIKeySite(req.Context(), input.Site)
+	if err != nil {
+		return batchError(err)
+	}
+
+	result, err := testSubmission(req.Context(), input)
+	if err != nil {
+		return batchError(err)
+	}
+
+	recordVerdict(req.Context(), input, result)
+
+	jsonString, err := json.Marshal(result.response())
+	if err != nil {
+		return batchError(err)
+	}
+	return jsonString
+}
+
+//
+// batchError returns the JSON-encoded result for a failed submission.
+//
+func batchError(err error) []byte {
+	jsonString, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return jsonString
+}
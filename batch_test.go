@@ -0,0 +1,178 @@
+//
+// Test for our batch end-point.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//
+// Post the given body to the batch end-point of a real server, via our
+// router, and return the lines of the response.
+//
+// The recorder of httptest doesn't behave as a HTTP/1 server does when
+// we write whilst still reading, so we test against a server.
+//
+func postBatch(t *testing.T, body string) []string {
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/batch", "application/x-ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if status := res.StatusCode; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+//
+// largeBatch returns a stream of submissions, many more than we test
+// concurrently, each of which will be blocked by 35-name.js.
+//
+func largeBatch() (string, int) {
+
+	var body strings.Builder
+	count := 50 * batchWorkers
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&body, `{"comment":"Moi Kissa %d","name":"http://example.com","site":"example.com","ip":"127.0.0.1","options":"exclude=velocity"}`+"\n", i)
+	}
+	return body.String(), count
+}
+
+//
+// Test that a JSON array gives results in order.
+//
+func TestBatchArray(t *testing.T) {
+
+	body := `[
+  {"comment":"Moi Kissa","name":"http://example.com","site":"example.com","ip":"127.0.0.1"},
+  {"comment":"Moi Kissa","name":"Steve","site":"example.com","ip":"127.0.0.1","options":"exclude=80-sfs"},
+  {"comment":"Moi Kissa","site":"example.com"}
+]`
+
+	lines := postBatch(t, body)
+	if len(lines) != 3 {
+		t.Fatalf("Unexpected response: %v", lines)
+	}
+	if !strings.Contains(lines[0], "\"blocker\":\"35-name.js\"") {
+		t.Errorf("Unexpected result: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], "\"result\":\"OK\"") {
+		t.Errorf("Unexpected result: %s", lines[1])
+	}
+	if !strings.Contains(lines[2], "\"blocker\":\"30-mandatory.js\"") {
+		t.Errorf("Unexpected result: %s", lines[2])
+	}
+}
+
+//
+// Test that a stream of JSON objects works, and that bogus JSON is
+// reported in place.
+//
+func TestBatchStream(t *testing.T) {
+
+	body := `{"comment":"Moi Kissa","name":"http://example.com","site":"example.com","ip":"127.0.0.1"}
+{"comment":"Moi Kissa","site":"example.com"}
+{"comment",}
+{"comment":"Never tested"}
+`
+
+	lines := postBatch(t, body)
+	if len(lines) != 3 {
+		t.Fatalf("Unexpected response: %v", lines)
+	}
+	if !strings.Contains(lines[0], "\"blocker\":\"35-name.js\"") {
+		t.Errorf("Unexpected result: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], "\"blocker\":\"30-mandatory.js\"") {
+		t.Errorf("Unexpected result: %s", lines[1])
+	}
+	if !strings.Contains(lines[2], "\"error\"") {
+		t.Errorf("Unexpected result: %s", lines[2])
+	}
+}
+
+//
+// Test that a batch larger than our queue is streamed in full when it
+// is posted to a real server, through our router and its middleware.
+//
+func TestBatchServer(t *testing.T) {
+
+	body, count := largeBatch()
+
+	lines := postBatch(t, body)
+	if len(lines) != count {
+		t.Fatalf("Expected %d results, got %d", count, len(lines))
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, "\"blocker\":\"35-name.js\"") {
+			t.Fatalf("Unexpected result %d: %s", i, line)
+		}
+	}
+}
+
+//
+// Test that a large batch is tested in full by a server without
+// full-duplex support, such as the recorder of httptest.
+//
+func TestBatchBuffered(t *testing.T) {
+
+	body, count := largeBatch()
+
+	req, err := http.NewRequest("POST", "/batch", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(BatchHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != count {
+		t.Errorf("Expected %d results, got %d", count, len(lines))
+	}
+}
+
+//
+// Test that an empty batch is rejected.
+//
+func TestBatchEmpty(t *testing.T) {
+
+	for _, body := range []string{"", "  \n"} {
+		req, err := http.NewRequest("POST", "/batch", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(BatchHandler)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("Unexpected status-code for '%s': %v", body, status)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+//
+//  A cache of the answers of our network lookups.
+//
+//  Every submission from the same IP, or with the same links, would
+// otherwise trigger the same DNS and HTTP lookups.  We cache both
+// positive and negative answers, for a time which depends upon their
+// source:
+//
+//    dnsbl   DNS-based blacklists
+//    mx      MX records
+//    sfs     StopForumSpam
+//
+//  Failed lookups are never cached, so that they're retried.
+//
+//  The cache is stored in redis, if available, so that it is shared
+// between servers.  Otherwise it is stored in memory, holding a limited
+// number of the most recently used answers.
+//
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//
+// The time we cache the answers of each source for, zero to disable.
+//
+// This may be changed via the `-cache-ttl` flag.
+//
+var cacheTTLs = map[string]time.Duration{
+	"dnsbl": time.Hour,
+	"mx":    6 * time.Hour,
+	"sfs":   time.Hour,
+}
+
+//
+// The number of answers we cache in memory, if redis is not available.
+//
+// This may be changed via the `-cache-size` flag.
+//
+var cacheSize = 10000
+
+//
+// cacheEntry is a single answer cached in memory.
+//
+type cacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+//
+// The answers cached in memory, with the most recently used at the
+// front of the list.
+//
+var (
+	cacheList  = list.New()
+	cacheIndex = make(map[string]*list.Element)
+	cacheLock  sync.Mutex
+)
+
+//
+// The number of hits, and misses, for each source.
+//
+var (
+	cacheHits     = make(map[string]int64)
+	cacheMisses   = make(map[string]int64)
+	cacheStatLock sync.Mutex
+)
+
+//
+// parseCacheTTLs parses TTLs of the form "dnsbl=1h,mx=6h", updating
+// those of the named sources.
+//
+func parseCacheTTLs(str string) error {
+
+	for _, pair := range strings.Split(str, ",") {
+		if len(pair) == 0 {
+			continue
+		}
+
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("expected source=duration, got '%s'", pair)
+		}
+
+		if _, ok := cacheTTLs[fields[0]]; !ok {
+			return fmt.Errorf("unknown cache source '%s'", fields[0])
+		}
+
+		ttl, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return err
+		}
+		cacheTTLs[fields[0]] = ttl
+	}
+	return nil
+}
+
+//
+// cacheGet returns the cached answer for the given key, if any.
+//
+func cacheGet(key string, now time.Time) (string, bool) {
+
+	if redisHandle != nil {
+		value, err := redisHandle.Get("cache-" + key).Result()
+		if err != nil {
+			if err != redis.Nil {
+				fmt.Printf("WARNING redis-error reading cache %s - %s\n", key, err.Error())
+			}
+			return "", false
+		}
+		return value, true
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	element, ok := cacheIndex[key]
+	if !ok {
+		return "", false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		cacheList.Remove(element)
+		delete(cacheIndex, key)
+		return "", false
+	}
+
+	cacheList.MoveToFront(element)
+	return entry.value, true
+}
+
+//
+// cacheSet stores the answer for the given key.
+//
+func cacheSet(key string, value string, ttl time.Duration, now time.Time) {
+
+	if redisHandle != nil {
+		err := redisHandle.Set("cache-"+key, value, ttl).Err()
+		if err != nil {
+			fmt.Printf("WARNING redis-error writing cache %s - %s\n", key, err.Error())
+		}
+		return
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	if element, ok := cacheIndex[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = now.Add(ttl)
+		cacheList.MoveToFront(element)
+		return
+	}
+
+	cacheIndex[key] = cacheList.PushFront(&cacheEntry{key: key, value: value, expires: now.Add(ttl)})
+
+	//
+	// Drop the least recently used answers, if we're full.
+	//
+	for cacheList.Len() > cacheSize && cacheList.Len() > 0 {
+		oldest := cacheList.Back()
+		cacheList.Remove(oldest)
+		delete(cacheIndex, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+//
+// cached returns the answer to the given lookup, from the given source,
+// either from our cache or by invoking the given function and caching
+// what it returns.
+//
+// Errors returned by the function are not cached.
+//
+func cached(source string, key string, lookup func() (string, error)) (string, error) {
+
+	ttl := cacheTTLs[source]
+	if ttl <= 0 {
+		return lookup()
+	}
+
+	key = source + "-" + key
+	now := time.Now()
+
+	value, ok := cacheGet(key, now)
+
+	cacheStatLock.Lock()
+	if ok {
+		cacheHits[source]++
+	} else {
+		cacheMisses[source]++
+	}
+	cacheStatLock.Unlock()
+
+	if ok {
+		return value, nil
+	}
+
+	value, err := lookup()
+	if err != nil {
+		return value, err
+	}
+
+	cacheSet(key, value, ttl, now)
+	return value, nil
+}
+
+//
+// cacheStats returns the number of hits, and misses, of each source.
+//
+func cacheStats() map[string]int64 {
+
+	cacheStatLock.Lock()
+	defer cacheStatLock.Unlock()
+
+	ret := make(map[string]int64)
+	for source := range cacheTTLs {
+		ret[fmt.Sprintf("cache-%s-hits", source)] = cacheHits[source]
+		ret[fmt.Sprintf("cache-%s-misses", source)] = cacheMisses[source]
+	}
+	return ret
+}
@@ -0,0 +1,143 @@
+//
+// Test for our cache.
+//
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//
+// resetCache empties our in-memory cache, and its statistics.
+//
+func resetCache() {
+	cacheLock.Lock()
+	cacheList = list.New()
+	cacheIndex = make(map[string]*list.Element)
+	cacheLock.Unlock()
+
+	cacheStatLock.Lock()
+	cacheHits = make(map[string]int64)
+	cacheMisses = make(map[string]int64)
+	cacheStatLock.Unlock()
+}
+
+//
+// Test that answers are cached, and errors are not.
+//
+func TestCached(t *testing.T) {
+
+	resetCache()
+
+	calls := 0
+	lookup := func() (string, error) {
+		calls++
+		return "answer", nil
+	}
+
+	for i := 0; i < 3; i++ {
+		value, err := cached("dnsbl", "example.com", lookup)
+		if err != nil || value != "answer" {
+			t.Errorf("Unexpected result: %s %v", value, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Unexpected number of lookups: %d", calls)
+	}
+
+	failing := func() (string, error) {
+		calls++
+		return "", errors.New("failed")
+	}
+	for i := 0; i < 2; i++ {
+		_, err := cached("dnsbl", "example.org", failing)
+		if err == nil {
+			t.Errorf("Expected an error")
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Unexpected number of lookups: %d", calls)
+	}
+
+	stats := cacheStats()
+	if stats["cache-dnsbl-hits"] != 2 || stats["cache-dnsbl-misses"] != 3 {
+		t.Errorf("Unexpected statistics: %v", stats)
+	}
+}
+
+//
+// Test that answers expire, and the least recently used are dropped.
+//
+func TestCacheExpiry(t *testing.T) {
+
+	resetCache()
+
+	saved := cacheSize
+	cacheSize = 2
+	defer func() { cacheSize = saved }()
+
+	now := time.Now()
+	cacheSet("a", "1", time.Minute, now)
+	cacheSet("b", "2", time.Minute, now)
+
+	if _, ok := cacheGet("a", now); !ok {
+		t.Errorf("Missing answer")
+	}
+
+	// "b" is now the least recently used.
+	cacheSet("c", "3", time.Minute, now)
+
+	if _, ok := cacheGet("b", now); ok {
+		t.Errorf("Least recently used answer was kept")
+	}
+	if _, ok := cacheGet("a", now.Add(time.Minute)); ok {
+		t.Errorf("Expired answer was returned")
+	}
+	if value, ok := cacheGet("c", now); !ok || value != "3" {
+		t.Errorf("Unexpected answer: %s", value)
+	}
+}
+
+//
+// Test that negative answers from the network are cached.
+//
+func TestCacheNegative(t *testing.T) {
+
+	resetCache()
+
+	fake := &fakeResolver{}
+	withResolver(t, fake)
+
+	for i := 0; i < 2; i++ {
+		result, _ := validateMX(context.Background(), Submission{Email: "steve@example.invalid"})
+		if result != Spam {
+			t.Errorf("Unexpected response: '%v'", result)
+		}
+	}
+	if fake.queries != 1 {
+		t.Errorf("Unexpected number of queries: %d", fake.queries)
+	}
+}
+
+//
+// Test the parsing of TTLs.
+//
+func TestParseCacheTTLs(t *testing.T) {
+
+	saved := cacheTTLs["mx"]
+	defer func() { cacheTTLs["mx"] = saved }()
+
+	if err := parseCacheTTLs("mx=10m"); err != nil || cacheTTLs["mx"] != 10*time.Minute {
+		t.Errorf("Unexpected result: %v %s", err, cacheTTLs["mx"])
+	}
+	for _, input := range []string{"mx", "bogus=1h", "mx=soon"} {
+		if parseCacheTTLs(input) == nil {
+			t.Errorf("Expected an error parsing %s", input)
+		}
+	}
+}
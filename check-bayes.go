@@ -0,0 +1,287 @@
+//
+//  Score submissions against a trained bayesian classifier.
+//
+//  Moderators re-train comments via the `/classify` end-point, which
+// updates per-token counts of spam and ok submissions.  Those counts
+// live in redis when it is available, otherwise they are held in memory
+// and lost on restart.
+//
+//  Incoming submissions are tokenized in the same way and the token
+// probabilities are combined into a single spam-probability.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//
+// The probability at, or above, which a submission is considered SPAM.
+//
+// This may be changed via the `-bayes-threshold` flag.
+//
+var bayesThreshold = 0.9
+
+//
+// The number of submissions of each class which must have been trained
+// before we'll make any decision.
+//
+var bayesMinimum = 10
+
+//
+// The maximum number of tokens we'll consider when scoring, we use the
+// tokens which are furthest from neutral.
+//
+var bayesInteresting = 15
+
+//
+// bayesMemory holds our token-counts when redis is not available.
+//
+type bayesMemory struct {
+	sync.Mutex
+
+	//
+	// The number of times each token was trained, by class.
+	//
+	tokens map[string]map[string]int
+
+	//
+	// The number of submissions trained, by class.
+	//
+	totals map[string]int
+}
+
+//
+// The in-memory token-counts.
+//
+var bayesCounts = bayesMemory{
+	tokens: map[string]map[string]int{"spam": {}, "ok": {}},
+	totals: map[string]int{},
+}
+
+//
+// Register ourself as a blogspam-plugin.
+//
+func init() {
+	registerPlugin(BlogspamPlugin{Name: "55-bayes.js",
+		Description: "Score the submission against our trained classifier",
+		Author:      "Steve Kemp <steve@steve.org.uk>",
+		Test:        checkBayes})
+}
+
+//
+// Split the interesting fields of a submission into a set of tokens.
+//
+// Tokens from fields other than the comment are prefixed with their
+// field-name, so that a word in a name is distinct from the same word
+// in the body.
+//
+func bayesTokens(x Submission) []string {
+
+	fields := map[string]string{
+		"":         x.Comment,
+		"subject:": x.Subject,
+		"name:":    x.Name,
+		"link:":    x.Link,
+	}
+
+	//
+	// Use a map to ensure each token is only counted once.
+	//
+	seen := make(map[string]bool)
+
+	for prefix, value := range fields {
+		words := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+		for _, word := range words {
+			if len(word) < 3 || len(word) > 40 {
+				continue
+			}
+			seen[prefix+word] = true
+		}
+	}
+
+	var tokens []string
+	for token := range seen {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+//
+// Train the given submission as either "spam" or "ok".
+//
+func trainBayes(x Submission, class string) error {
+
+	if class != "spam" && class != "ok" {
+		return errors.New("train must be either 'spam' or 'ok'")
+	}
+
+	tokens := bayesTokens(x)
+
+	if redisHandle != nil {
+		pipe := redisHandle.Pipeline()
+		for _, token := range tokens {
+			pipe.HIncrBy(fmt.Sprintf("bayes-%s", class), token, 1)
+		}
+		pipe.Incr(fmt.Sprintf("bayes-%s-total", class))
+		_, err := pipe.Exec()
+		return err
+	}
+
+	bayesCounts.Lock()
+	defer bayesCounts.Unlock()
+
+	for _, token := range tokens {
+		bayesCounts.tokens[class][token]++
+	}
+	bayesCounts.totals[class]++
+	return nil
+}
+
+//
+// Retrieve the trained counts, for the given class, of each of the
+// specified tokens.  We also return the number of submissions trained
+// as that class.
+//
+func bayesLookup(class string, tokens []string) ([]int, int, error) {
+
+	counts := make([]int, len(tokens))
+
+	if redisHandle != nil {
+		total, err := redisHandle.Get(fmt.Sprintf("bayes-%s-total", class)).Int()
+		if err != nil {
+			// Nothing has been trained yet.
+			return counts, 0, nil
+		}
+		if len(tokens) == 0 {
+			return counts, total, nil
+		}
+
+		values, err := redisHandle.HMGet(fmt.Sprintf("bayes-%s", class), tokens...).Result()
+		if err != nil {
+			return counts, 0, err
+		}
+		for i, val := range values {
+			if str, ok := val.(string); ok {
+				fmt.Sscanf(str, "%d", &counts[i])
+			}
+		}
+		return counts, total, nil
+	}
+
+	bayesCounts.Lock()
+	defer bayesCounts.Unlock()
+
+	for i, token := range tokens {
+		counts[i] = bayesCounts.tokens[class][token]
+	}
+	return counts, bayesCounts.totals[class], nil
+}
+
+//
+// Calculate the probability that the given submission is spam.
+//
+// The boolean return value will be false if we've not been trained
+// sufficiently to make a decision.
+//
+func bayesProbability(x Submission) (float64, bool, error) {
+
+	tokens := bayesTokens(x)
+
+	spam, spamTotal, err := bayesLookup("spam", tokens)
+	if err != nil {
+		return 0, false, err
+	}
+	ok, okTotal, err := bayesLookup("ok", tokens)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if spamTotal < bayesMinimum || okTotal < bayesMinimum {
+		return 0, false, nil
+	}
+
+	//
+	// Work out the probability for each token we've seen before.
+	//
+	var probs []float64
+	for i := range tokens {
+		if spam[i]+ok[i] == 0 {
+			continue
+		}
+
+		s := float64(spam[i]) / float64(spamTotal)
+		h := float64(ok[i]) / float64(okTotal)
+		p := s / (s + h)
+
+		//
+		// Rarely-seen tokens are pulled towards neutral.
+		//
+		n := float64(spam[i] + ok[i])
+		p = (0.5 + n*p) / (1 + n)
+
+		p = math.Max(0.01, math.Min(0.99, p))
+		probs = append(probs, p)
+	}
+
+	if len(probs) == 0 {
+		return 0.5, true, nil
+	}
+
+	//
+	// Only use the most interesting tokens.
+	//
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > bayesInteresting {
+		probs = probs[:bayesInteresting]
+	}
+
+	//
+	// Combine them, using logarithms to avoid underflow.
+	//
+	spamLog := 0.0
+	hamLog := 0.0
+	for _, p := range probs {
+		spamLog += math.Log(p)
+		hamLog += math.Log(1 - p)
+	}
+
+	return 1 / (1 + math.Exp(hamLog-spamLog)), true, nil
+}
+
+//
+// Test the submission against our trained classifier.
+//
+func checkBayes(x Submission) (PluginResult, string) {
+
+	prob, trained, err := bayesProbability(x)
+	if err != nil {
+		return Error, err.Error()
+	}
+
+	//
+	// Without enough training we cannot decide.
+	//
+	if !trained {
+		return Undecided, ""
+	}
+
+	if prob >= bayesThreshold {
+		return Spam, fmt.Sprintf("Bayesian spam-probability is %.2f", prob)
+	}
+
+	return Undecided, ""
+}
@@ -0,0 +1,92 @@
+//
+// Test for our bayesian plugin.
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+//
+// Reset our in-memory token-counts.
+//
+func resetBayes() {
+	bayesCounts.Lock()
+	defer bayesCounts.Unlock()
+
+	bayesCounts.tokens = map[string]map[string]int{"spam": {}, "ok": {}}
+	bayesCounts.totals = map[string]int{}
+}
+
+//
+// Test that tokens are prefixed by their field.
+//
+func TestBayesTokens(t *testing.T) {
+
+	tokens := bayesTokens(Submission{Comment: "Buy cheap pills, buy!",
+		Name: "Steve", Link: "https://steve.fi/"})
+
+	expected := []string{"buy", "cheap", "link:https", "link:steve",
+		"name:steve", "pills"}
+
+	if strings.Join(tokens, ",") != strings.Join(expected, ",") {
+		t.Errorf("Unexpected tokens: '%v'", tokens)
+	}
+}
+
+//
+// Test that we cannot train an unknown class.
+//
+func TestBayesTrainBogus(t *testing.T) {
+
+	err := trainBayes(Submission{Comment: "Hello"}, "maybe")
+	if err == nil {
+		t.Errorf("Expected an error training a bogus class")
+	}
+}
+
+//
+// Without training we're always undecided.
+//
+func TestBayesUntrained(t *testing.T) {
+	resetBayes()
+
+	result, detail := checkBayes(Submission{Comment: "Buy cheap pills"})
+	if result != Undecided {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+	if len(detail) != 0 {
+		t.Errorf("Unexpected response: '%v'", detail)
+	}
+}
+
+//
+// Once trained we should spot spam, and leave ham alone.
+//
+func TestBayesTrained(t *testing.T) {
+	resetBayes()
+	defer resetBayes()
+
+	for i := 0; i < bayesMinimum; i++ {
+		trainBayes(Submission{Comment: "Buy cheap pills online today"}, "spam")
+		trainBayes(Submission{Comment: "I enjoyed reading this post about golang"}, "ok")
+	}
+
+	result, detail := checkBayes(Submission{Comment: "Cheap pills, buy them online"})
+	if result != Spam {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+	if !strings.Contains(detail, "probability") {
+		t.Errorf("Unexpected response: '%v'", detail)
+	}
+
+	result, detail = checkBayes(Submission{Comment: "Another great post about golang"})
+	if result != Undecided {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+	if len(detail) != 0 {
+		t.Errorf("Unexpected response: '%v'", detail)
+	}
+}
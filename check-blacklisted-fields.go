@@ -11,6 +11,28 @@
 //
 //  Simple.
 //
+//  Sites may have their own additions, which only apply to submissions
+// for that site, as well as allowlists which mark a submission as good:
+//
+//    echo pollen >> ./blacklist.d/sites/example.com/comment
+//    echo ^steve$ >> ./blacklist.d/sites/example.com/allow/name
+//
+//  Per-site patterns may also be stored in the redis sets named
+// "site-$site-blacklist-$field" and "site-$site-allowlist-$field".  The
+// site must also be added to the set "blacklist-sites", so that we know
+// to look for them:
+//
+//    SADD blacklist-sites example.com
+//    SADD site-example.com-blacklist-comment pollen
+//
+//  The files are reloaded whenever they change, or when the server
+// receives a SIGHUP, so there is no need to restart.  Redis cannot tell
+// us when its sets change, so the patterns stored there are reloaded
+// every `-blacklist-refresh`, as well as upon a SIGHUP.  Changes made
+// via the admin API are announced on the redis channel named
+// "blacklist-reload", so that every server sharing redis reloads at
+// once.  Patterns are compiled as they are loaded, and any which are
+// invalid are skipped and reported.
 //
 
 package main
@@ -20,64 +42,707 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"regexp/syntax"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-redis/redis"
 )
 
 //
-// We store blacklisted field-data here
+// The directories we load blacklisted field-data from.
+//
+var blacklistDirectories = []string{"./blacklist.d/", "/etc/blogspam/blacklist.d/"}
+
+//
+// How often we reload the patterns stored in redis, zero to disable.
+//
+// This may be changed via the `-blacklist-refresh` flag.
+//
+var blacklistRefresh = time.Minute
+
+//
+// The redis channel on which we announce changes to our blacklists.
 //
-var blacklisted map[string][]string
+const blacklistChannel = "blacklist-reload"
 
 //
-// Store the data from the specified file into our blacklisted-map
+// A fieldBlacklist holds the compiled patterns for a single field.
+//
+// Patterns which are plain literals are combined into one regular
+// expression, which is matched as a single automaton, so that large
+// lists of literals remain fast.  Other patterns are matched one by
+// one.
 //
-func readData(path string, name string) error {
+type fieldBlacklist struct {
+	//
+	// The source of each pattern, as it was loaded.
+	//
+	patterns []string
+
+	//
+	// All the literal patterns, combined.
+	//
+	literals *regexp.Regexp
+
+	//
+	// The remaining patterns.
+	//
+	regexps []*regexp.Regexp
+}
+
+//
+// newFieldBlacklist compiles the given, previously validated, patterns.
+//
+func newFieldBlacklist(patterns []string) *fieldBlacklist {
+
+	ret := &fieldBlacklist{patterns: patterns}
+
+	var literals []string
+
+	for _, pattern := range patterns {
+		if isLiteralPattern(pattern) {
+			literals = append(literals, "(?:"+pattern+")")
+		} else {
+			ret.regexps = append(ret.regexps, regexp.MustCompile("(?i)"+pattern))
+		}
+	}
+
+	if len(literals) > 0 {
+		ret.literals = regexp.MustCompile("(?i)(?:" + strings.Join(literals, "|") + ")")
+	}
+	return ret
+}
+
+//
+// isLiteralPattern returns true if the given pattern matches only a
+// literal string.
+//
+func isLiteralPattern(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	return re.Op == syntax.OpLiteral
+}
+
+//
+// matches returns true if any of our patterns match the given value.
+//
+func (f *fieldBlacklist) matches(value string) bool {
+
+	if f.literals != nil && f.literals.MatchString(value) {
+		return true
+	}
+
+	for _, re := range f.regexps {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// blacklistData holds all of our compiled blacklists.
+//
+type blacklistData struct {
+	//
+	// The global blacklists, by field.
+	//
+	fields map[string]*fieldBlacklist
+
+	//
+	// The per-site blacklists, by site and then field.
+	//
+	sites map[string]map[string]*fieldBlacklist
+
+	//
+	// The per-site allowlists, by site and then field.
+	//
+	allowed map[string]map[string]*fieldBlacklist
+}
+
+//
+// We store blacklisted field-data here.
+//
+// This is replaced, never modified, when we reload so readers must
+// fetch it via blacklistedFields.
+//
+var blacklisted *blacklistData
+
+//
+// The lock protecting the blacklisted map.
+//
+var blacklistedLock sync.RWMutex
+
+//
+// The lock serializing changes made via the admin API, so that
+// concurrent changes to the same file cannot lose one another.
+//
+var blacklistEditLock sync.Mutex
+
+//
+// Store the data from the specified file into the given map of patterns.
+//
+// Each line is a regular expression, and any which fail to compile
+// are skipped and reported, along with their location.
+//
+func readData(path string, name string, into map[string][]string) ([]error, error) {
 
 	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
+	var invalid []error
+
+	line := 0
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		blacklisted[name] = append(blacklisted[name], scanner.Text())
+		line++
+
+		pattern := scanner.Text()
+		if len(pattern) == 0 {
+			continue
+		}
+
+		//
+		// We make patterns case-insensitive with the "(?i)" prefix
+		//
+		_, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("%s:%d: invalid pattern - %s", path, line, err.Error()))
+			continue
+		}
+
+		into[name] = append(into[name], pattern)
 	}
 
-	return scanner.Err()
+	return invalid, scanner.Err()
 }
 
 //
-// Process the given configuration-directory
+// Process the given configuration-directory, returning details of any
+// invalid patterns found.
 //
-func processDirectory(dir string) {
+func processDirectory(dir string, into map[string][]string) []error {
+
+	var invalid []error
 
 	files, err := ioutil.ReadDir(dir)
 	if err == nil {
 		for _, f := range files {
-			readData(fmt.Sprintf("%s/%s", dir, f.Name()), f.Name())
+			if f.IsDir() {
+				continue
+			}
+			errs, _ := readData(fmt.Sprintf("%s/%s", dir, f.Name()), f.Name(), into)
+			invalid = append(invalid, errs...)
 		}
 	}
 
+	return invalid
 }
 
 //
-// Register ourselves as a plugin, after setting up our config-files.
+// Process the per-site directories beneath the given directory.
 //
-func init() {
+// Each site has a directory of blacklisted patterns, as well as an
+// optional "allow" directory of allowlisted patterns:
+//
+//    sites/example.com/comment
+//    sites/example.com/allow/name
+//
+func processSites(dir string, sites map[string]map[string][]string, allowed map[string]map[string][]string) []error {
+
+	var invalid []error
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return invalid
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		site := siteKey(entry.Name())
+		if sites[site] == nil {
+			sites[site] = make(map[string][]string)
+		}
+		if allowed[site] == nil {
+			allowed[site] = make(map[string][]string)
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		invalid = append(invalid, processDirectory(path, sites[site])...)
+		invalid = append(invalid, processDirectory(filepath.Join(path, "allow"), allowed[site])...)
+	}
+
+	return invalid
+}
+
+//
+// siteKey converts the site of a submission into the form we use to
+// find its blacklists; the lower-cased hostname and path, without any
+// scheme or trailing slash, with any further slashes replaced by "_".
+//
+func siteKey(site string) string {
+	site = strings.ToLower(site)
+	site = strings.TrimPrefix(site, "http://")
+	site = strings.TrimPrefix(site, "https://")
+	site = strings.TrimRight(site, "/")
+	return strings.Replace(site, "/", "_", -1)
+}
+
+//
+// Process the patterns stored in redis, if it is available, returning
+// details of any invalid patterns found.
+//
+// Global patterns for each field are stored in a set named after the
+// field, and per-site patterns in sets named after the site and field,
+// for each of the sites in the set "blacklist-sites".
+//
+func processRedis(global map[string][]string, sites map[string]map[string][]string, allowed map[string]map[string][]string) []error {
+
+	var invalid []error
+
+	if redisHandle == nil {
+		return invalid
+	}
+
+	//
+	// Find the sites which have their own sets.
+	//
+	members, err := redisHandle.SMembers("blacklist-sites").Result()
+	if err != nil {
+		invalid = append(invalid, fmt.Errorf("redis blacklist-sites: %s", err.Error()))
+	}
+
+	//
+	// Fetch every set we're interested in, at once.
+	//
+	type redisSet struct {
+		key   string
+		field string
+		into  map[string][]string
+		cmd   *redis.StringSliceCmd
+	}
+	var sets []redisSet
+
+	pipe := redisHandle.Pipeline()
+
+	for _, member := range members {
+
+		site := siteKey(member)
+
+		for _, kind := range []string{"blacklist", "allowlist"} {
+
+			into := sites
+			if kind == "allowlist" {
+				into = allowed
+			}
+			if into[site] == nil {
+				into[site] = make(map[string][]string)
+			}
+
+			for field := range blacklistFieldNames() {
+				key := fmt.Sprintf("site-%s-%s-%s", member, kind, field)
+				sets = append(sets, redisSet{key, field, into[site], pipe.SMembers(key)})
+			}
+		}
+	}
+
+	for field := range blacklistFieldNames() {
+		key := fmt.Sprintf("blacklist-patterns-%s", field)
+		sets = append(sets, redisSet{key, field, global, pipe.SMembers(key)})
+	}
+
+	//
+	// Errors are reported against each set.
+	//
+	pipe.Exec()
+
+	for _, set := range sets {
+		invalid = append(invalid, processRedisSet(set.key, set.field, set.cmd, set.into)...)
+	}
+
+	return invalid
+}
+
+//
+// Store the patterns from the given redis-set, as fetched by the given
+// command, into the given map of patterns, returning details of any
+// invalid patterns found.
+//
+func processRedisSet(key string, field string, cmd *redis.StringSliceCmd, into map[string][]string) []error {
+
+	var invalid []error
+
+	patterns, err := cmd.Result()
+	if err != nil {
+		invalid = append(invalid, fmt.Errorf("redis %s: %s", key, err.Error()))
+		return invalid
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		_, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("redis %s: invalid pattern - %s", key, err.Error()))
+			continue
+		}
+		into[field] = append(into[field], pattern)
+	}
+
+	return invalid
+}
+
+//
+// blacklistFieldNames returns the names of the fields which may be
+// blacklisted; the string-fields of our Submission structure.
+//
+func blacklistFieldNames() map[string]bool {
+
+	ret := make(map[string]bool)
+
+	t := reflect.TypeOf(Submission{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.String {
+			ret[strings.ToLower(t.Field(i).Name)] = true
+		}
+	}
+	return ret
+}
+
+//
+// addBlacklistPattern adds a new pattern for the given field, and
+// reloads our blacklists so that it takes effect immediately.
+//
+// The pattern is stored in redis, if available, otherwise it is
+// appended to the file for the field in our first directory.
+//
+func addBlacklistPattern(field string, pattern string) error {
+
+	blacklistEditLock.Lock()
+	defer blacklistEditLock.Unlock()
+
+	if redisHandle != nil {
+		err := redisHandle.SAdd(fmt.Sprintf("blacklist-patterns-%s", field), pattern).Err()
+		if err != nil {
+			return err
+		}
+	} else {
+		path := filepath.Join(blacklistDirectories[0], field)
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(file, "%s\n", pattern)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	announceBlacklists()
+	return nil
+}
+
+//
+// removeBlacklistPattern removes the given pattern for the given field,
+// and reloads our blacklists so that the change takes effect immediately.
+//
+// The pattern is removed from redis, if available, and from the files
+// for the field in each of our directories.
+//
+func removeBlacklistPattern(field string, pattern string) error {
+
+	blacklistEditLock.Lock()
+	defer blacklistEditLock.Unlock()
+
+	if redisHandle != nil {
+		err := redisHandle.SRem(fmt.Sprintf("blacklist-patterns-%s", field), pattern).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range blacklistDirectories {
+
+		path := filepath.Join(dir, field)
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		//
+		// Keep all the lines which don't match.
+		//
+		var keep []string
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		for _, line := range lines {
+			if line != pattern {
+				keep = append(keep, line)
+			}
+		}
+
+		if len(keep) == len(lines) {
+			continue
+		}
+
+		out := strings.Join(keep, "\n")
+		if len(keep) > 0 {
+			out += "\n"
+		}
+		err = ioutil.WriteFile(path, []byte(out), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	announceBlacklists()
+	return nil
+}
+
+//
+// announceBlacklists reloads our blacklists, and tells the other
+// servers sharing our redis, if any, to do the same.
+//
+func announceBlacklists() {
+
+	reloadBlacklists()
+
+	if redisHandle != nil {
+		err := redisHandle.Publish(blacklistChannel, "").Err()
+		if err != nil {
+			fmt.Printf("WARNING redis-error announcing blacklist changes - %s\n", err.Error())
+		}
+	}
+}
+
+//
+// blacklistedFields returns the current blacklisted field-data.
+//
+func blacklistedFields() *blacklistData {
+	blacklistedLock.RLock()
+	defer blacklistedLock.RUnlock()
+
+	return blacklisted
+}
+
+//
+// compileFields compiles each of the given lists of patterns, and
+// records the number loaded in the given counts using the given prefix.
+//
+func compileFields(fields map[string][]string, prefix string, counts map[string]int) map[string]*fieldBlacklist {
+
+	ret := make(map[string]*fieldBlacklist)
+	for field, patterns := range fields {
+		ret[field] = newFieldBlacklist(patterns)
+		counts[prefix+field] = len(patterns)
+	}
+	return ret
+}
+
+//
+// reloadBlacklists reads our configuration-directories and replaces
+// the blacklisted field-data with their contents.
+//
+// The number of patterns loaded for each field is returned, along with
+// details of any invalid patterns which were skipped.  Per-site fields
+// are counted as "sites/$site/$field" and "sites/$site/allow/$field".
+//
+func reloadBlacklists() (map[string]int, []error) {
 
 	//
-	// Create a map to hold our per-field lists
+	// Create maps to hold our per-field lists
 	//
-	blacklisted = make(map[string][]string)
+	global := make(map[string][]string)
+	sites := make(map[string]map[string][]string)
+	allowed := make(map[string]map[string][]string)
 
 	//
 	// Look for a set of field-based config-files.
 	//
-	processDirectory("./blacklist.d/")
-	processDirectory("/etc/blogspam/blacklist.d/")
+	var invalid []error
+	for _, dir := range blacklistDirectories {
+		invalid = append(invalid, processDirectory(dir, global)...)
+		invalid = append(invalid, processSites(filepath.Join(dir, "sites"), sites, allowed)...)
+	}
+
+	//
+	// Add any patterns stored in redis.
+	//
+	invalid = append(invalid, processRedis(global, sites, allowed)...)
+
+	//
+	// Compile them.
+	//
+	counts := make(map[string]int)
+	compiled := &blacklistData{
+		fields:  compileFields(global, "", counts),
+		sites:   make(map[string]map[string]*fieldBlacklist),
+		allowed: make(map[string]map[string]*fieldBlacklist),
+	}
+	for site, fields := range sites {
+		compiled.sites[site] = compileFields(fields, "sites/"+site+"/", counts)
+	}
+	for site, fields := range allowed {
+		compiled.allowed[site] = compileFields(fields, "sites/"+site+"/allow/", counts)
+	}
+
+	//
+	// Swap it into place.
+	//
+	blacklistedLock.Lock()
+	blacklisted = compiled
+	blacklistedLock.Unlock()
+
+	return counts, invalid
+}
+
+//
+// reportBlacklists reloads our blacklists and shows the number of
+// patterns loaded for each field.
+//
+func reportBlacklists() {
+
+	counts, invalid := reloadBlacklists()
+
+	for _, err := range invalid {
+		fmt.Printf("WARNING - %s\n", err.Error())
+	}
+
+	var fields []string
+	for field := range counts {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		fmt.Printf("Loaded %d patterns for %s\n", counts[field], field)
+	}
+}
+
+//
+// watchDirectories adds each of our configuration-directories, and
+// any directories beneath them, to the given watcher.
+//
+func watchDirectories(watcher *fsnotify.Watcher) {
+
+	for _, dir := range blacklistDirectories {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				watcher.Add(path)
+			}
+			return nil
+		})
+	}
+}
+
+//
+// watchBlacklists reloads our blacklists whenever the files in our
+// configuration-directories change, when we receive a SIGHUP, and if
+// redis is available when a change is announced, and periodically.
+//
+func watchBlacklists() {
+
+	//
+	// Reload on SIGHUP.
+	//
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	//
+	// Reload the patterns stored in redis periodically.
+	//
+	var refresh <-chan time.Time
+	if redisHandle != nil && blacklistRefresh > 0 {
+		refresh = time.NewTicker(blacklistRefresh).C
+	}
+
+	//
+	// Reload when another server announces a change.
+	//
+	var announced <-chan *redis.Message
+	if redisHandle != nil {
+		announced = redisHandle.Subscribe(blacklistChannel).Channel()
+	}
+
+	//
+	// Reload when a file changes, if we can.
+	//
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Printf("WARNING - Failed to watch blacklists - %s\n", err.Error())
+	} else {
+		events = watcher.Events
+		errs = watcher.Errors
+		watchDirectories(watcher)
+	}
+
+	go func() {
+
+		//
+		// Editors tend to generate several events when saving a
+		// file, so we wait for things to settle before reloading.
+		//
+		settle := time.NewTimer(time.Hour)
+		settle.Stop()
+
+		for {
+			select {
+			case <-hup:
+				fmt.Printf("Received SIGHUP, reloading blacklists\n")
+				reportBlacklists()
+			case <-announced:
+				fmt.Printf("Blacklists changed in redis, reloading\n")
+				reportBlacklists()
+			case <-refresh:
+				_, invalid := reloadBlacklists()
+				for _, err := range invalid {
+					fmt.Printf("WARNING - %s\n", err.Error())
+				}
+			case <-events:
+				settle.Reset(time.Second)
+			case err := <-errs:
+				fmt.Printf("WARNING - Error watching blacklists - %s\n", err.Error())
+			case <-settle.C:
+				fmt.Printf("Blacklists changed, reloading\n")
+				reportBlacklists()
+
+				// There might be new per-site directories.
+				watchDirectories(watcher)
+			}
+		}
+	}()
+}
+
+//
+// Register ourselves as a plugin, after setting up our config-files.
+//
+func init() {
+
+	reloadBlacklists()
 
 	registerPlugin(BlogspamPlugin{Name: "05-blacklisted-fields.js",
 		Description: "Look for blacklisted patterns in fields",
@@ -86,12 +751,45 @@ func init() {
 }
 
 //
-// Test the incoming submission against our blacklist.
+// Test the incoming submission against our blacklists.
+//
+// If the site of the submission has an allowlist which matches we
+// decide the submission is good, otherwise we look at the global and
+// per-site blacklists.
 //
 func checkBlacklistedFields(x Submission) (PluginResult, string) {
 
 	//
 	// We've got a list of fields, and a map of blacklists.
+	//
+	blacklist := blacklistedFields()
+	site := siteKey(x.Site)
+
+	if field := matchFields(x, blacklist.allowed[site]); len(field) > 0 {
+		return Ham, fmt.Sprintf("Allowlisted value in %s-field", field)
+	}
+
+	if field := matchFields(x, blacklist.fields); len(field) > 0 {
+		return Spam, fmt.Sprintf("Blacklisted value in %s-field", field)
+	}
+
+	if field := matchFields(x, blacklist.sites[site]); len(field) > 0 {
+		return Spam, fmt.Sprintf("Blacklisted value in %s-field", field)
+	}
+
+	return Undecided, ""
+}
+
+//
+// matchFields returns the name of the first field of the submission
+// which is matched by the given lists of patterns, if any.
+//
+func matchFields(x Submission, lists map[string]*fieldBlacklist) string {
+
+	if len(lists) == 0 {
+		return ""
+	}
+
 	//
 	// Get all the fields of the structure, via reflection
 	//
@@ -106,30 +804,23 @@ func checkBlacklistedFields(x Submission) (PluginResult, string) {
 		// The specific field
 		f := s.Field(i)
 
+		// Only strings may be blacklisted
+		if f.Kind() != reflect.String {
+			continue
+		}
+
 		// The name/value of the field
 		fieldName := typeOfT.Field(i).Name
-		fieldVal := fmt.Sprintf("%s", f.Interface())
-
-		// Now we have an array of blacklisted items
-		items := blacklisted[strings.ToLower(fieldName)]
+		fieldVal := f.String()
 
-		// We'll iterate over them.
-		for _, val := range items {
-
-			//
-			// Each item is a regular expression.
-			//
-			// We make them case-insensitive with the "(?i)" prefix
-			//
-			re := regexp.MustCompile("(?i)" + val)
-			match := re.FindStringSubmatch(fieldVal)
-
-			if len(match) > 0 {
-				return Spam, fmt.Sprintf("Blacklisted value in %s-field", fieldName)
-			}
+		// Now we have the patterns for this field
+		items, ok := lists[strings.ToLower(fieldName)]
 
+		// Do any of them match?
+		if ok && items.matches(fieldVal) {
+			return fieldName
 		}
 	}
 
-	return Undecided, ""
+	return ""
 }
@@ -5,6 +5,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -51,3 +55,170 @@ func TestBlacklistedLinkFields(t *testing.T) {
 		}
 	}
 }
+
+//
+// Test that reloading replaces our blacklists.
+//
+func TestBlacklistReload(t *testing.T) {
+
+	dir := t.TempDir()
+
+	saved := blacklistDirectories
+	blacklistDirectories = []string{dir}
+	defer func() {
+		blacklistDirectories = saved
+		reloadBlacklists()
+	}()
+
+	err := ioutil.WriteFile(filepath.Join(dir, "name"), []byte("^steve$\n^kemp$\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, _ := reloadBlacklists()
+	if len(counts) != 1 || counts["name"] != 2 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+
+	result, _ := checkBlacklistedFields(Submission{Name: "Steve"})
+	if result != Spam {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+
+	//
+	// Now update the file, and reload.
+	//
+	err = ioutil.WriteFile(filepath.Join(dir, "name"), []byte("^kemp$\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, _ = reloadBlacklists()
+	if counts["name"] != 1 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+
+	result, _ = checkBlacklistedFields(Submission{Name: "Steve"})
+	if result != Undecided {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+}
+
+//
+// Test that invalid patterns are skipped, and reported by location.
+//
+func TestBlacklistInvalid(t *testing.T) {
+
+	dir := t.TempDir()
+
+	saved := blacklistDirectories
+	blacklistDirectories = []string{dir}
+	defer func() {
+		blacklistDirectories = saved
+		reloadBlacklists()
+	}()
+
+	err := ioutil.WriteFile(filepath.Join(dir, "subject"), []byte("cheap\n\nbroken(\n^buy\\s+\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, invalid := reloadBlacklists()
+	if counts["subject"] != 2 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+	if len(invalid) != 1 {
+		t.Fatalf("Unexpected errors: %v", invalid)
+	}
+	if !strings.Contains(invalid[0].Error(), "subject:3:") {
+		t.Errorf("Unexpected error: %v", invalid[0])
+	}
+
+	inputs := map[string]PluginResult{
+		"CHEAP stuff":    Spam,
+		"Buy  things":    Spam,
+		"I would buy it": Undecided,
+	}
+	for input, expected := range inputs {
+		result, _ := checkBlacklistedFields(Submission{Subject: input})
+		if result != expected {
+			t.Errorf("Unexpected response for '%s': '%v'", input, result)
+		}
+	}
+}
+
+//
+// Test that we spot literal patterns.
+//
+func TestBlacklistLiteral(t *testing.T) {
+
+	inputs := map[string]bool{
+		"StarSEO Marketing": true,
+		"xberi\\.net":       true,
+		"pcgle.com":         false,
+		"^buy\\s+":          false,
+	}
+
+	for input, expected := range inputs {
+		if isLiteralPattern(input) != expected {
+			t.Errorf("Unexpected result for '%s'", input)
+		}
+	}
+}
+
+//
+// Test that per-site blacklists, and allowlists, only apply to their site.
+//
+func TestBlacklistPerSite(t *testing.T) {
+
+	dir := t.TempDir()
+
+	saved := blacklistDirectories
+	blacklistDirectories = []string{dir}
+	defer func() {
+		blacklistDirectories = saved
+		reloadBlacklists()
+	}()
+
+	files := map[string]string{
+		"comment":                        "viagra\n",
+		"sites/example.com/comment":      "pollen\n",
+		"sites/example.com/allow/name":   "^steve$\n",
+		"sites/steve.fi_blog/allow/name": "^kemp$\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, _ := reloadBlacklists()
+	if counts["comment"] != 1 || counts["sites/example.com/comment"] != 1 ||
+		counts["sites/example.com/allow/name"] != 1 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+
+	type TestCase struct {
+		Input  Submission
+		Result PluginResult
+	}
+
+	tests := []TestCase{
+		{Submission{Site: "https://example.com/", Comment: "Nice pollen"}, Spam},
+		{Submission{Site: "https://example.org/", Comment: "Nice pollen"}, Undecided},
+		{Submission{Site: "https://example.org/", Comment: "Buy viagra"}, Spam},
+		{Submission{Site: "https://example.com/", Comment: "Buy viagra", Name: "Steve"}, Ham},
+		{Submission{Site: "https://example.org/", Comment: "Buy viagra", Name: "Steve"}, Spam},
+		{Submission{Site: "http://steve.fi/blog/", Comment: "Buy viagra", Name: "Kemp"}, Ham},
+	}
+
+	for _, test := range tests {
+		result, _ := checkBlacklistedFields(test.Input)
+		if result != test.Result {
+			t.Errorf("Unexpected response for %v: '%v'", test.Input, result)
+		}
+	}
+}
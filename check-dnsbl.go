@@ -0,0 +1,477 @@
+//
+//  Test submissions against DNS-based blacklists.
+//
+//  Each blacklist, or zone, we use is described in a JSON file, and
+// becomes a plugin of its own.  There are two types of zone:
+//
+//    ip      The address of the submitter is looked up, as with
+//            dronebl.org or Spamhaus ZEN.
+//
+//    domain  The hostname of each link in the comment is looked up,
+//            as with surbl.org or Spamhaus DBL.
+//
+//  A zone may list the meanings of the addresses it returns, in which
+// case only those addresses count as a listing:
+//
+//    {"name": "60-zen.js",
+//     "list": "Spamhaus ZEN",
+//     "zone": "zen.spamhaus.org",
+//     "type": "ip",
+//     "weight": 2,
+//     "timeout": "2s",
+//     "codes": {"127.0.0.2": "SBL", "127.0.0.4": "XBL"}}
+//
+//  Otherwise any reply at all counts.
+//
+//  IPv6 submitters are only looked up in ip zones which support them,
+// as marked by "ipv6": true.
+//
+//  Zones such as surbl.org combine several lists, and return an address
+// whose final octet is a bitmask of the lists a domain appears upon.
+// These bits may be named instead:
+//
+//     "bitmask": {"8": "PH", "16": "MW", "64": "ABUSE", "128": "CR"}
+//
+//  Sites may choose to ignore some lists, by name or by the meaning of
+// a code, via the "ignore-list" option.
+//
+//  For domain zones we lookup the registered domain of each link, for
+// example "spammer.co.uk" for "www.spammer.co.uk", as that is what the
+// lists contain.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mvdan.cc/xurls"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+//
+// The files we look for our zones within; the first which exists is
+// used.
+//
+var dnsblConfigFiles = []string{"./dnsbl.json", "/etc/blogspam/dnsbl.json"}
+
+//
+// The zones we use if none of our files exist.
+//
+var dnsblDefaultZones = []dnsblZone{
+	{Name: "60-drone.js",
+		Description: "Test IP of the comment-submitter against dronebl.org",
+		List:        "dronebl.org",
+		Zone:        "dnsbl.dronebl.org",
+		Type:        "ip",
+		IPv6:        true,
+		Weight:      1,
+		Timeout:     "3s"},
+	{Name: "60-surbl.js",
+		Description: "Test links in messages against surbl.org",
+		List:        "surbl.org",
+		Zone:        "multi.surbl.org",
+		Type:        "domain",
+		Weight:      1,
+		Timeout:     "3s",
+		Bitmask:     map[string]string{"8": "PH", "16": "MW", "64": "ABUSE", "128": "CR"}},
+}
+
+//
+// dnsblZone describes a single DNS-based blacklist.
+//
+type dnsblZone struct {
+	//
+	// The name of the plugin for this zone.
+	//
+	Name string
+
+	//
+	// The description of the plugin.
+	//
+	Description string
+
+	//
+	// The name of the list, as shown to the caller.
+	//
+	List string
+
+	//
+	// The zone beneath which we make our lookups.
+	//
+	Zone string
+
+	//
+	// The type of zone, "ip" or "domain".
+	//
+	Type string
+
+	//
+	// Does an ip zone list IPv6 addresses?
+	//
+	IPv6 bool
+
+	//
+	// The weight of the plugin, see scoring.go.
+	//
+	Weight float64
+
+	//
+	// The maximum time to spend on lookups, if any.
+	//
+	Timeout string
+
+	//
+	// The meanings of the addresses the zone returns, if only some
+	// of them indicate a listing.
+	//
+	Codes map[string]string
+
+	//
+	// The names of the bits of the final octet of the addresses the
+	// zone returns, if it combines several lists.
+	//
+	Bitmask map[string]string
+
+	//
+	// The parsed timeout.
+	//
+	timeout time.Duration
+
+	//
+	// The parsed bitmask, in order.
+	//
+	bits []dnsblBit
+}
+
+//
+// dnsblBit is a single named bit of a bitmask.
+//
+type dnsblBit struct {
+	value int
+	name  string
+}
+
+//
+// Register a plugin for each of our zones.
+//
+func init() {
+
+	zones, err := loadDNSBLZones()
+	if err != nil {
+		fmt.Printf("WARNING - Using the default DNSBL zones - %s\n", err.Error())
+		zones, _ = validateDNSBLZones(dnsblDefaultZones)
+	}
+
+	for _, zone := range zones {
+		registerPlugin(BlogspamPlugin{Name: zone.Name,
+			Description: zone.Description,
+			Author:      "Steve Kemp <steve@steve.org.uk>",
+			ContextTest: zone.check,
+			Weight:      zone.Weight,
+			Network:     true,
+			RedisCache:  true})
+	}
+}
+
+//
+// loadDNSBLZones reads our zones from the first of our configuration
+// files which exists, or returns the defaults if there are none.
+//
+func loadDNSBLZones() ([]dnsblZone, error) {
+
+	for _, path := range dnsblConfigFiles {
+
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var zones []dnsblZone
+		err = json.Unmarshal(data, &zones)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		zones, err = validateDNSBLZones(zones)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		return zones, nil
+	}
+
+	return validateDNSBLZones(dnsblDefaultZones)
+}
+
+//
+// validateDNSBLZones ensures each of the given zones is complete, and
+// parses their timeouts.
+//
+func validateDNSBLZones(zones []dnsblZone) ([]dnsblZone, error) {
+
+	var ret []dnsblZone
+
+	for _, zone := range zones {
+
+		if len(zone.Name) == 0 || len(zone.Zone) == 0 {
+			return nil, errors.New("each zone must have a name, and a zone")
+		}
+
+		if zone.Type != "ip" && zone.Type != "domain" {
+			return nil, fmt.Errorf("zone %s has unknown type '%s'", zone.Name, zone.Type)
+		}
+
+		if zone.IPv6 && zone.Type != "ip" {
+			return nil, fmt.Errorf("zone %s is not an ip zone, so cannot support IPv6", zone.Name)
+		}
+
+		if len(zone.List) == 0 {
+			zone.List = zone.Zone
+		}
+
+		if len(zone.Timeout) > 0 {
+			timeout, err := time.ParseDuration(zone.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("zone %s has invalid timeout - %s", zone.Name, err.Error())
+			}
+			zone.timeout = timeout
+		}
+
+		for value, name := range zone.Bitmask {
+			bit, err := strconv.Atoi(value)
+			if err != nil || bit <= 0 || bit > 255 || bit&(bit-1) != 0 {
+				return nil, fmt.Errorf("zone %s has invalid bit '%s'", zone.Name, value)
+			}
+			zone.bits = append(zone.bits, dnsblBit{value: bit, name: name})
+		}
+		sort.Slice(zone.bits, func(i, j int) bool {
+			return zone.bits[i].value < zone.bits[j].value
+		})
+
+		ret = append(ret, zone)
+	}
+	return ret, nil
+}
+
+//
+// dnsblHosts returns the hostnames of the links in the comment of the
+// given submission.
+//
+func dnsblHosts(x Submission) []string {
+
+	//
+	// We'll store hosts here, to ensure we don't have duplicates.
+	//
+	hosts := make(map[string]bool)
+
+	//
+	// Find the links in the body of our comment.
+	//
+	urlsRe := xurls.Relaxed()
+	links := urlsRe.FindAllString(x.Comment, -1)
+
+	for _, link := range links {
+
+		//
+		// If we don't have a protocol-prefix, add it.
+		//
+		if !strings.HasPrefix(link, "http://") &&
+			!strings.HasPrefix(link, "https://") {
+			link = "http://" + link
+		}
+
+		//
+		// Now parse out the hostname of the link.
+		//
+		u, err := url.Parse(link)
+		if err == nil && len(u.Hostname()) > 0 {
+			hosts[strings.ToLower(u.Hostname())] = true
+		}
+	}
+
+	var ret []string
+	for host := range hosts {
+		ret = append(ret, host)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//
+// dnsblDomain returns the name we lookup beneath a domain zone for the
+// given hostname.
+//
+// This is the registered domain of the host, or the reversed address if
+// the host is an IP.
+//
+func dnsblDomain(host string) string {
+
+	host = strings.ToLower(host)
+
+	if reversed := reverseIP(host); len(reversed) > 0 {
+		return reversed
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+//
+// meanings returns the names of the listings indicated by the given
+// reply, and whether the reply indicates a listing at all.
+//
+func (z dnsblZone) meanings(addr string) ([]string, bool) {
+
+	if len(z.bits) > 0 {
+		ip := normalizeIP(addr)
+		if ip == nil || len(ip) != net.IPv4len {
+			return nil, false
+		}
+
+		var names []string
+		for _, bit := range z.bits {
+			if int(ip[3])&bit.value != 0 {
+				names = append(names, bit.name)
+			}
+		}
+		return names, len(names) > 0
+	}
+
+	if len(z.Codes) > 0 {
+		meaning, ok := z.Codes[addr]
+		if !ok {
+			return nil, false
+		}
+		return []string{meaning}, true
+	}
+
+	return nil, true
+}
+
+//
+// listed looks up the given name beneath our zone, returning whether it
+// is listed, and the meanings of the listing if known.
+//
+// Listings whose meanings are all ignored don't count.
+//
+func (z dnsblZone) listed(ctx context.Context, name string, ignore []string) (bool, []string) {
+
+	//
+	// Lookup the name, caching the addresses it has, if any.
+	//
+	lookup := name + "." + z.Zone
+	answer, _ := cached("dnsbl", lookup, func() (string, error) {
+		reply, err := resolver.LookupHost(ctx, lookup)
+		if isNotFound(err) {
+			return "", nil
+		}
+		return strings.Join(reply, ","), err
+	})
+
+	var reply []string
+	if len(answer) > 0 {
+		reply = strings.Split(answer, ",")
+	}
+
+	for _, addr := range reply {
+
+		names, ok := z.meanings(addr)
+		if !ok {
+			continue
+		}
+		if len(names) == 0 {
+			return true, nil
+		}
+
+		var remaining []string
+		for _, n := range names {
+			if !isIgnoredList(n, ignore) {
+				remaining = append(remaining, n)
+			}
+		}
+		if len(remaining) > 0 {
+			return true, remaining
+		}
+	}
+	return false, nil
+}
+
+//
+// isIgnoredList returns true if the given list is one of those ignored.
+//
+func isIgnoredList(name string, ignore []string) bool {
+	for _, i := range ignore {
+		if strings.EqualFold(name, i) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// check tests the given submission against our zone.
+//
+func (z dnsblZone) check(ctx context.Context, x Submission) (PluginResult, string) {
+
+	if z.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, z.timeout)
+		defer cancel()
+	}
+
+	//
+	// Work out what we're going to lookup.
+	//
+	var names []string
+	if z.Type == "ip" {
+		ip := normalizeIP(x.IP)
+		if ip != nil && (ip.To4() != nil || z.IPv6) {
+			names = append(names, reverseIP(x.IP))
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, host := range dnsblHosts(x) {
+			domain := dnsblDomain(host)
+			if !seen[domain] {
+				seen[domain] = true
+				names = append(names, domain)
+			}
+		}
+	}
+
+	for _, name := range names {
+
+		listed, meanings := z.listed(ctx, name, x.Options.IgnoreLists)
+		if !listed {
+			continue
+		}
+
+		reason := fmt.Sprintf("%s is listed in %s", x.IP, z.List)
+		if z.Type == "domain" {
+			reason = fmt.Sprintf("Posted link(s) listed in %s", z.List)
+		}
+		if len(meanings) > 0 {
+			reason += " (" + strings.Join(meanings, ", ") + ")"
+		}
+		return Spam, reason
+	}
+
+	return Undecided, ""
+}
@@ -0,0 +1,278 @@
+//
+// Test for our DNSBL plugins.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// dnsblTestZone returns the zone with the given name, from our default
+// configuration.
+//
+func dnsblTestZone(t *testing.T, name string) dnsblZone {
+
+	zones, err := loadDNSBLZones()
+	if err != nil {
+		t.Fatalf("Failed to load zones: %s", err.Error())
+	}
+	for _, zone := range zones {
+		if zone.Name == name {
+			return zone
+		}
+	}
+	t.Fatalf("Zone %s not found", name)
+	return dnsblZone{}
+}
+
+//
+// Test that our shipped configuration matches our defaults.
+//
+func TestDNSBLConfig(t *testing.T) {
+
+	loaded, err := loadDNSBLZones()
+	if err != nil {
+		t.Fatalf("Failed to load zones: %s", err.Error())
+	}
+	defaults, _ := validateDNSBLZones(dnsblDefaultZones)
+
+	if !reflect.DeepEqual(loaded, defaults) {
+		t.Errorf("Configuration differs from defaults: %+v", loaded)
+	}
+}
+
+//
+// Test that bogus configurations are rejected.
+//
+func TestDNSBLConfigInvalid(t *testing.T) {
+
+	saved := dnsblConfigFiles
+	defer func() { dnsblConfigFiles = saved }()
+
+	inputs := []string{`{`,
+		`[{"name":"bogus.js"}]`,
+		`[{"name":"bogus.js","zone":"example.com","type":"url"}]`,
+		`[{"name":"bogus.js","zone":"example.com","type":"ip","timeout":"soon"}]`,
+		`[{"name":"bogus.js","zone":"example.com","type":"ip","bitmask":{"3":"X"}}]`,
+		`[{"name":"bogus.js","zone":"example.com","type":"domain","ipv6":true}]`,
+	}
+
+	for _, input := range inputs {
+		path := filepath.Join(t.TempDir(), "dnsbl.json")
+		ioutil.WriteFile(path, []byte(input), 0644)
+		dnsblConfigFiles = []string{path}
+
+		_, err := loadDNSBLZones()
+		if err == nil {
+			t.Errorf("Expected an error loading %s", input)
+		}
+	}
+}
+
+//
+// Test the hosts we find in comments.
+//
+func TestDNSBLHosts(t *testing.T) {
+
+	hosts := dnsblHosts(Submission{Comment: "See http://Example.com/foo and example.com, https://www.example.org:8080/bar"})
+
+	if !reflect.DeepEqual(hosts, []string{"example.com", "www.example.org"}) {
+		t.Errorf("Unexpected hosts: %v", hosts)
+	}
+}
+
+//
+// Test IPs that should never be listed.
+//
+func TestNonDrone(t *testing.T) {
+
+	withResolver(t, &fakeResolver{})
+	zone := dnsblTestZone(t, "60-drone.js")
+
+	//
+	// Test several IPs
+	//
+	inputs := []string{"127.0.0.1",
+		"192.168.0.1",
+		"10.11.12.13",
+		"not-an-ip"}
+
+	for _, input := range inputs {
+
+		result, detail := zone.check(context.Background(), Submission{IP: input})
+
+		if result != Undecided {
+			t.Errorf("Unexpected response: '%v'", result)
+		}
+		if len(detail) != 0 {
+			t.Errorf("Unexpected response: '%v'", detail)
+		}
+	}
+}
+
+//
+// Test a known-bad IP
+//
+func TestDroneListed(t *testing.T) {
+
+	fake := &fakeResolver{hosts: map[string][]string{
+		"111.241.255.116.dnsbl.dronebl.org": {"127.0.0.3"},
+	}}
+	fake.hosts[reverseIP("2001:db8::1")+".dnsbl.dronebl.org"] = []string{"127.0.0.3"}
+	withResolver(t, fake)
+	zone := dnsblTestZone(t, "60-drone.js")
+
+	inputs := []string{"116.255.241.111",
+		"::ffff:116.255.241.111",
+		"2001:db8::1"}
+
+	for _, input := range inputs {
+		result, detail := zone.check(context.Background(), Submission{IP: input})
+
+		if result != Spam {
+			t.Errorf("Unexpected response for %s: '%v'", input, result)
+		}
+		if !strings.Contains(detail, "listed in dronebl.org") {
+			t.Errorf("Unexpected response for %s: '%v'", input, detail)
+		}
+	}
+
+	//
+	// Zones which don't support IPv6 aren't asked about it.
+	//
+	zone.IPv6 = false
+	for input, expected := range map[string]PluginResult{"2001:db8::1": Undecided, "::ffff:116.255.241.111": Spam} {
+		result, _ := zone.check(context.Background(), Submission{IP: input})
+		if result != expected {
+			t.Errorf("Unexpected response for %s without IPv6: '%v'", input, result)
+		}
+	}
+}
+
+//
+// Test links that should never be listed.
+//
+func TestNonSurbl(t *testing.T) {
+
+	withResolver(t, &fakeResolver{})
+	zone := dnsblTestZone(t, "60-surbl.js")
+
+	result, detail := zone.check(context.Background(), Submission{Comment: "Moi kissa, no URLs here steve.fi/anal.rape https://gibberish.steve.fi/fuck.you"})
+
+	if result != Undecided {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+	if len(detail) != 0 {
+		t.Errorf("Unexpected response: '%v'", detail)
+	}
+}
+
+//
+// Test an example that is currently listed in Surbl
+//
+func TestSurblListed(t *testing.T) {
+
+	withResolver(t, &fakeResolver{hosts: map[string][]string{
+		"xblog.in.multi.surbl.org": {"127.0.0.72"},
+	}})
+	zone := dnsblTestZone(t, "60-surbl.js")
+
+	result, detail := zone.check(context.Background(), Submission{Comment: "Listed link: http://pornapps.xblog.in"})
+
+	if result != Spam {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+	if detail != "Posted link(s) listed in surbl.org (PH, ABUSE)" {
+		t.Errorf("Unexpected response: '%v'", detail)
+	}
+
+	//
+	// Sites may ignore some lists.
+	//
+	result, detail = zone.check(context.Background(), Submission{Comment: "Listed link: http://pornapps.xblog.in",
+		Options: parseOptions("ignore-list=abuse")})
+
+	if result != Spam || detail != "Posted link(s) listed in surbl.org (PH)" {
+		t.Errorf("Unexpected response: '%v' '%v'", result, detail)
+	}
+
+	result, _ = zone.check(context.Background(), Submission{Comment: "Listed link: http://pornapps.xblog.in",
+		Options: parseOptions("ignore-list=abuse,ignore-list=PH")})
+
+	if result != Undecided {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+}
+
+//
+// Test that we lookup the registered domains of links.
+//
+func TestDNSBLDomain(t *testing.T) {
+
+	inputs := map[string]string{
+		"www.spammer.com":      "spammer.com",
+		"a.b.spammer.co.uk":    "spammer.co.uk",
+		"spammer.com":          "spammer.com",
+		"co.uk":                "co.uk",
+		"192.0.2.1":            "1.2.0.192",
+		"pornapps.xblog.in":    "xblog.in",
+		"foo.blogspot.com":     "foo.blogspot.com",
+		"bar.foo.blogspot.com": "foo.blogspot.com",
+		"WWW.Example.ORG":      "example.org",
+	}
+
+	for input, expected := range inputs {
+		if output := dnsblDomain(input); output != expected {
+			t.Errorf("Unexpected domain for %s: %s", input, output)
+		}
+	}
+}
+
+//
+// Test that the replies of zones are decoded.
+//
+func TestDNSBLMeanings(t *testing.T) {
+
+	surbl := dnsblTestZone(t, "60-surbl.js")
+
+	type TestCase struct {
+		Reply    string
+		Meanings []string
+		Listed   bool
+	}
+
+	tests := []TestCase{
+		{"127.0.0.8", []string{"PH"}, true},
+		{"127.0.0.24", []string{"PH", "MW"}, true},
+		{"127.0.0.200", []string{"PH", "ABUSE", "CR"}, true},
+		{"127.0.0.1", nil, false},
+		{"bogus", nil, false},
+	}
+
+	for _, test := range tests {
+		meanings, listed := surbl.meanings(test.Reply)
+		if listed != test.Listed || !reflect.DeepEqual(meanings, test.Meanings) {
+			t.Errorf("Unexpected meanings for %s: %v %v", test.Reply, meanings, listed)
+		}
+	}
+
+	codes, _ := validateDNSBLZones([]dnsblZone{{Name: "zen.js", Zone: "zen.spamhaus.org", Type: "ip",
+		Codes: map[string]string{"127.0.0.2": "SBL"}}})
+
+	if meanings, listed := codes[0].meanings("127.0.0.2"); !listed || !reflect.DeepEqual(meanings, []string{"SBL"}) {
+		t.Errorf("Unexpected meanings for a code: %v", meanings)
+	}
+	if _, listed := codes[0].meanings("127.0.0.10"); listed {
+		t.Errorf("Unknown code was listed")
+	}
+	if _, listed := dnsblTestZone(t, "60-drone.js").meanings("127.0.0.3"); !listed {
+		t.Errorf("Reply without codes was not listed")
+	}
+}
@@ -0,0 +1,318 @@
+//
+//  Look for the same comment being posted to many sites.
+//
+//  Spam campaigns post the same text, or trivial variations of it, to
+// many blogs within minutes.  We fingerprint each comment twice:
+//
+//    1.  A hash of the normalized text, which finds exact copies.
+//
+//    2.  A SimHash of the normalized text, which finds near-copies, as
+//        similar texts have SimHashes differing in only a few bits.
+//
+//  We remember the fingerprints of recent comments, and the sites they
+// were posted to.  If the same, or similar, comment has been posted to
+// more than the permitted number of distinct sites within our window
+// the submission is SPAM.
+//
+//  The fingerprints are stored in redis, if available, so that they're
+// shared between servers.  Otherwise they're stored in memory.  Either
+// way they're indexed by the exact hash, and by each band of the
+// SimHash, so that we only look at comments which might match.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis"
+)
+
+//
+// The window within which we remember comments.
+//
+// This may be changed via the `-duplicate-window` flag.
+//
+var duplicateWindow = 10 * time.Minute
+
+//
+// The number of distinct sites a comment may be posted to within our
+// window, zero to disable.
+//
+// This may be changed via the `-duplicate-sites` flag.
+//
+var duplicateSites = 3
+
+//
+// The maximum number of bits by which two SimHashes may differ for the
+// comments to be considered near-duplicates.
+//
+// This must be less than the number of bands, see duplicateBands.
+//
+var duplicateDistance = 3
+
+//
+// Comments with fewer words than this are ignored, as short comments
+// such as "Thanks!" are legitimately repeated.
+//
+var duplicateMinWords = 8
+
+//
+// The number of 16-bit bands we split each SimHash into.
+//
+// Since near-duplicates differ in at most duplicateDistance bits at
+// least one of their bands must be identical, so we only need compare
+// SimHashes which share a band.  Wide bands keep the number of
+// candidates sharing a band small.
+//
+const duplicateBands = 4
+
+//
+// The maximum number of recent entries we look at for each key, and
+// keep in each sorted-set in redis, so that the work done for each
+// submission is bounded however busy we are.
+//
+const duplicateSetSize = 500
+
+//
+// duplicateEntry is a comment we've seen, when redis is not available.
+//
+type duplicateEntry struct {
+	sum     string
+	simhash uint64
+	site    string
+	seen    time.Time
+}
+
+//
+// The comments we've seen, in the order we saw them, and indexed by
+// the same keys we use in redis, if redis is not available.
+//
+var (
+	duplicateEntries []*duplicateEntry
+	duplicateIndex   = make(map[string][]*duplicateEntry)
+	duplicateLock    sync.Mutex
+)
+
+//
+// Register ourself as a blogspam-plugin.
+//
+func init() {
+	registerPlugin(BlogspamPlugin{Name: "45-duplicate.js",
+		Description: "Look for the same comment being posted to many sites.",
+		Author:      "Steve Kemp <steve@steve.org.uk>",
+		ContextTest: checkDuplicate})
+}
+
+//
+// duplicateWords returns the words of the given text, lower-cased and
+// without punctuation.
+//
+func duplicateWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+//
+// duplicateSum returns the hash of the normalized text.
+//
+func duplicateSum(words []string) string {
+	sum := sha1.Sum([]byte(strings.Join(words, " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// duplicateSimHash returns the SimHash of the given words.
+//
+// Comments are short, so we use each word as a feature; using phrases
+// would mean that changing a single word changed too many features.
+//
+func duplicateSimHash(words []string) uint64 {
+
+	var counts [64]int
+
+	for _, word := range words {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		feature := h.Sum64()
+
+		for bit := 0; bit < 64; bit++ {
+			if feature&(1<<uint(bit)) != 0 {
+				counts[bit]++
+			} else {
+				counts[bit]--
+			}
+		}
+	}
+
+	var ret uint64
+	for bit := 0; bit < 64; bit++ {
+		if counts[bit] > 0 {
+			ret |= 1 << uint(bit)
+		}
+	}
+	return ret
+}
+
+//
+// duplicateSimilar returns true if the given SimHashes are close
+// enough for their comments to be near-duplicates.
+//
+func duplicateSimilar(a uint64, b uint64) bool {
+	return bits.OnesCount64(a^b) <= duplicateDistance
+}
+
+//
+// duplicateKeys returns the keys beneath which we index a comment; that
+// of its exact hash, followed by one for each band of its SimHash.
+//
+func duplicateKeys(sum string, simhash uint64) []string {
+
+	keys := []string{fmt.Sprintf("duplicate-%s", sum)}
+	for band := uint(0); band < duplicateBands; band++ {
+		keys = append(keys, fmt.Sprintf("duplicate-band-%d-%04x", band, (simhash>>(16*band))&0xffff))
+	}
+	return keys
+}
+
+//
+// duplicateRecord records that a comment was posted to the given site,
+// and returns the number of distinct sites the same, or a similar,
+// comment has been posted to within our window.
+//
+// If record is false the comment is counted, but not recorded.
+//
+func duplicateRecord(sum string, simhash uint64, site string, now time.Time, record bool) (int, error) {
+
+	cutoff := now.Add(-duplicateWindow)
+	sites := map[string]bool{site: true}
+	keys := duplicateKeys(sum, simhash)
+
+	if redisHandle != nil {
+
+		//
+		// Each exact copy, and each band of the SimHash, has a
+		// sorted-set of the sites it was seen upon, scored by
+		// the time it was seen, and capped at the most recent
+		// duplicateSetSize entries.
+		//
+		min := strconv.FormatInt(cutoff.UnixNano(), 10)
+		pipe := redisHandle.TxPipeline()
+		var members []*redis.StringSliceCmd
+		for i, key := range keys {
+			member := site
+			if i > 0 {
+				member = fmt.Sprintf("%016x %s", simhash, site)
+			}
+			if record {
+				pipe.ZRemRangeByScore(key, "-inf", min)
+				pipe.ZAdd(key, redis.Z{Score: float64(now.UnixNano()), Member: member})
+				pipe.ZRemRangeByRank(key, 0, -duplicateSetSize-1)
+				pipe.Expire(key, duplicateWindow)
+			}
+			members = append(members, pipe.ZRangeByScore(key, redis.ZRangeBy{Min: "(" + min, Max: "+inf", Count: duplicateSetSize}))
+		}
+		_, err := pipe.Exec()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, s := range members[0].Val() {
+			sites[s] = true
+		}
+		for _, band := range members[1:] {
+			for _, member := range band.Val() {
+				fields := strings.SplitN(member, " ", 2)
+				if len(fields) != 2 {
+					continue
+				}
+				other, err := strconv.ParseUint(fields[0], 16, 64)
+				if err == nil && duplicateSimilar(simhash, other) {
+					sites[fields[1]] = true
+				}
+			}
+		}
+		return len(sites), nil
+	}
+
+	duplicateLock.Lock()
+	defer duplicateLock.Unlock()
+
+	//
+	// Drop the entries which have expired, which are all at the
+	// start since we append in the order we see them.  For the same
+	// reason each is also the first entry beneath each of its keys.
+	//
+	for len(duplicateEntries) > 0 && !duplicateEntries[0].seen.After(cutoff) {
+		entry := duplicateEntries[0]
+		duplicateEntries = duplicateEntries[1:]
+
+		for _, key := range duplicateKeys(entry.sum, entry.simhash) {
+			if len(duplicateIndex[key]) > 1 {
+				duplicateIndex[key] = duplicateIndex[key][1:]
+			} else {
+				delete(duplicateIndex, key)
+			}
+		}
+	}
+
+	if record {
+		entry := &duplicateEntry{sum: sum, simhash: simhash, site: site, seen: now}
+		duplicateEntries = append(duplicateEntries, entry)
+		for _, key := range keys {
+			duplicateIndex[key] = append(duplicateIndex[key], entry)
+		}
+	}
+
+	//
+	// Look at the most recent entries beneath each of our keys.
+	//
+	for i, key := range keys {
+		entries := duplicateIndex[key]
+		if len(entries) > duplicateSetSize {
+			entries = entries[len(entries)-duplicateSetSize:]
+		}
+		for _, entry := range entries {
+			if i == 0 || duplicateSimilar(entry.simhash, simhash) {
+				sites[entry.site] = true
+			}
+		}
+	}
+	return len(sites), nil
+}
+
+//
+// Test that the comment hasn't been posted to too many other sites.
+//
+func checkDuplicate(ctx context.Context, x Submission) (PluginResult, string) {
+
+	if duplicateSites <= 0 {
+		return Undecided, ""
+	}
+
+	words := duplicateWords(x.Comment)
+	if len(words) < duplicateMinWords {
+		return Undecided, ""
+	}
+
+	count, err := duplicateRecord(duplicateSum(words), duplicateSimHash(words), siteKey(x.Site), time.Now(), !isDryRun(ctx))
+	if err != nil {
+		return Error, err.Error()
+	}
+
+	if count > duplicateSites {
+		return Spam, fmt.Sprintf("Comment posted to %d sites within %s", count, duplicateWindow)
+	}
+	return Undecided, ""
+}
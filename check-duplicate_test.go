@@ -0,0 +1,130 @@
+//
+// Test for our duplicate-plugin.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// The comment we post in our tests.
+//
+var duplicateComment = "Buy the very best cheap watches online today, with free shipping to anywhere in the world and a money back guarantee on every single order you place with us. Visit our shop now!"
+
+//
+// Test that normalization ignores case, and punctuation.
+//
+func TestDuplicateNormalize(t *testing.T) {
+
+	a := duplicateWords("Hello, World!  How are   you?")
+	b := duplicateWords("hello world how ARE you")
+
+	if duplicateSum(a) != duplicateSum(b) {
+		t.Errorf("Normalized hashes differ: %v %v", a, b)
+	}
+}
+
+//
+// Test that near-duplicates have similar SimHashes.
+//
+func TestDuplicateSimHash(t *testing.T) {
+
+	a := duplicateSimHash(duplicateWords(duplicateComment))
+	b := duplicateSimHash(duplicateWords(strings.Replace(duplicateComment, "Visit our shop now!", "Visit our store now!", 1)))
+	c := duplicateSimHash(duplicateWords("I really enjoyed reading this post about gardening, and I will try planting tomatoes next to the basil this spring as you suggest."))
+
+	if !duplicateSimilar(a, b) {
+		t.Errorf("Near-duplicates were not similar: %016x %016x", a, b)
+	}
+	if duplicateSimilar(a, c) {
+		t.Errorf("Different comments were similar: %016x %016x", a, c)
+	}
+}
+
+//
+// Test that posting to too many sites is spam.
+//
+func TestDuplicate(t *testing.T) {
+
+	saved := duplicateSites
+	duplicateSites = 2
+	defer func() { duplicateSites = saved }()
+
+	//
+	// Posting repeatedly to the same site doesn't count.
+	//
+	for i := 0; i < 5; i++ {
+		result, detail := checkDuplicate(context.Background(), Submission{Site: "http://one.example.com/", Comment: duplicateComment})
+		if result != Undecided {
+			t.Errorf("Unexpected result: %v %s", result, detail)
+		}
+	}
+
+	result, detail := checkDuplicate(context.Background(), Submission{Site: "two.example.com", Comment: strings.ToUpper(duplicateComment)})
+	if result != Undecided {
+		t.Errorf("Unexpected result: %v %s", result, detail)
+	}
+
+	//
+	// A similar comment on a third site is spam.
+	//
+	similar := strings.Replace(duplicateComment, "Visit our shop now!", "Visit our store now!", 1)
+	result, detail = checkDuplicate(context.Background(), Submission{Site: "three.example.com", Comment: similar})
+	if result != Spam || !strings.Contains(detail, "3 sites") {
+		t.Errorf("Unexpected result: %v %s", result, detail)
+	}
+
+	//
+	// Short comments are ignored.
+	//
+	for i := 0; i < 5; i++ {
+		result, _ = checkDuplicate(context.Background(), Submission{Site: fmt.Sprintf("%d.example.com", i), Comment: "Thanks, great post!"})
+		if result != Undecided {
+			t.Errorf("Unexpected result for a short comment: %v", result)
+		}
+	}
+}
+
+//
+// Test that expired comments are dropped from our index.
+//
+func TestDuplicateExpiry(t *testing.T) {
+
+	duplicateLock.Lock()
+	savedEntries, savedIndex := duplicateEntries, duplicateIndex
+	duplicateEntries, duplicateIndex = nil, make(map[string][]*duplicateEntry)
+	duplicateLock.Unlock()
+
+	defer func() {
+		duplicateLock.Lock()
+		duplicateEntries, duplicateIndex = savedEntries, savedIndex
+		duplicateLock.Unlock()
+	}()
+
+	words := duplicateWords(duplicateComment)
+	sum, simhash := duplicateSum(words), duplicateSimHash(words)
+
+	now := time.Now()
+	duplicateRecord(sum, simhash, "one.example.com", now, true)
+	count, _ := duplicateRecord(sum, simhash, "two.example.com", now.Add(time.Second), true)
+	if count != 2 {
+		t.Errorf("Unexpected count: %d", count)
+	}
+	if len(duplicateIndex) != 1+duplicateBands {
+		t.Errorf("Unexpected number of keys: %d", len(duplicateIndex))
+	}
+
+	count, _ = duplicateRecord(sum, simhash, "three.example.com", now.Add(duplicateWindow+time.Second), false)
+	if count != 1 {
+		t.Errorf("Unexpected count after expiry: %d", count)
+	}
+	if len(duplicateEntries) != 0 || len(duplicateIndex) != 0 {
+		t.Errorf("Expired entries remain: %d %d", len(duplicateEntries), len(duplicateIndex))
+	}
+}
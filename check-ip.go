@@ -7,7 +7,6 @@ package main
 import (
 	"fmt"
 	"net"
-	"regexp"
 	"strings"
 )
 
@@ -27,34 +26,6 @@ func init() {
 //
 func checkBlacklist(x Submission) (PluginResult, string) {
 
-	//
-	// Map to store any IPs we're to blacklist
-	//
-	tmp := make(map[string]int)
-
-	//
-	// Do we have options?
-	//
-	if len(x.Options) > 0 {
-
-		//
-		// Split the string into an array, based on commas
-		//
-		options := strings.Split(x.Options, ",")
-
-		//
-		// Now look for key=val
-		//
-		for _, option := range options {
-			re := regexp.MustCompile("blacklist=([^=]+)$")
-			match := re.FindStringSubmatch(option)
-
-			if len(match) > 0 {
-				tmp[match[1]] = 1
-			}
-		}
-	}
-
 	//
 	// The source IP we're going to test against the blacklisted entries.
 	//
@@ -63,7 +34,7 @@ func checkBlacklist(x Submission) (PluginResult, string) {
 	//
 	// If we have some blacklisted IPs..
 	//
-	for ip := range tmp {
+	for _, ip := range x.Options.Blacklist {
 
 		// Only parse the CIDR if it looks like one.
 		if strings.Contains(ip, "/") {
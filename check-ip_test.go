@@ -26,7 +26,7 @@ func TestIPBlacklistOne(t *testing.T) {
 	// This should pass - the IP is outside the CIDR range
 	//
 	result, detail := checkBlacklist(Submission{Email: "moi@exampl.fi",
-		Subject: "Hello", IP: "10.20.30.48", Options: "blacklist=10.20.30.40/29"})
+		Subject: "Hello", IP: "10.20.30.48", Options: parseOptions("blacklist=10.20.30.40/29")})
 	if result != Undecided {
 		t.Errorf("Unexpected response: '%v'", result)
 	}
@@ -41,7 +41,7 @@ func TestIPBlacklistTwo(t *testing.T) {
 	// This should fail the source IP is inside the blacklist.
 	//
 	result, detail := checkBlacklist(Submission{Email: "moi@exampl.fi",
-		Subject: "Hello", IP: "10.20.30.47", Options: "blacklist=10.20.30.40/29"})
+		Subject: "Hello", IP: "10.20.30.47", Options: parseOptions("blacklist=10.20.30.40/29")})
 	if result != Spam {
 		t.Errorf("Unexpected response: '%v'", result)
 	}
@@ -56,7 +56,7 @@ func TestIPBlacklistBogusCIDR(t *testing.T) {
 	// This should fail, as the CIDR is bogus.
 	//
 	result, detail := checkBlacklist(Submission{Email: "moi@exampl.fi",
-		Subject: "Hello", IP: "10.20.30.47", Options: "blacklist=10.20.30.40/329"})
+		Subject: "Hello", IP: "10.20.30.47", Options: parseOptions("blacklist=10.20.30.40/329")})
 	if result != Error {
 		t.Errorf("Unexpected result: '%v'", result)
 	}
@@ -75,7 +75,7 @@ func TestIPBlacklistLiterally(t *testing.T) {
 	// This should fail as the IP is blacklisted.
 	//
 	result, detail := checkBlacklist(Submission{Email: "moi@exampl.fi",
-		Subject: "Hello", IP: "10.20.30.47", Options: "blacklist=10.20.30.47"})
+		Subject: "Hello", IP: "10.20.30.47", Options: parseOptions("blacklist=10.20.30.47")})
 	if result != Spam {
 		t.Errorf("Unexpected result: '%v'", result)
 	}
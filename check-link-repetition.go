@@ -15,7 +15,8 @@ func init() {
 	registerPlugin(BlogspamPlugin{Name: "33-link-body.js",
 		Description: "Look for the link repeated in the body.",
 		Author:      "Steve Kemp <steve@steve.org.uk>",
-		Test:        checkRepetitiveLinks})
+		Test:        checkRepetitiveLinks,
+		Weight:      0.5})
 }
 
 //
@@ -7,8 +7,6 @@ package main
 import (
 	"index/suffixarray"
 	"regexp"
-	"strconv"
-	"strings"
 )
 
 //
@@ -25,47 +23,18 @@ func init() {
 func checkHyperlinkCounts(x Submission) (PluginResult, string) {
 
 	//
-	// Map to store any options we find.
+	// Was the option bogus?
 	//
-	tmp := make(map[string]string)
-
-	//
-	// Default failure threshold.
-	//
-	tmp["max-links"] = "10"
-
-	//
-	// Do we have options?
-	//
-	if len(x.Options) > 0 {
-
-		//
-		// Split the string into an array, based on commas
-		//
-		options := strings.Split(x.Options, ",")
-
-		//
-		// Now look for key=val
-		//
-		for _, option := range options {
-			re := regexp.MustCompile("^(.*)=([^=]+)$")
-			match := re.FindStringSubmatch(option)
-
-			if len(match) > 0 {
-				tmp[match[1]] = match[2]
-			}
-		}
+	if detail, ok := x.Options.Invalid["max-links"]; ok {
+		return Error, detail
 	}
 
 	//
-	// Now convert our (possibly updated) max value
+	// Default failure threshold, unless overridden.
 	//
-	max, err := strconv.Atoi(tmp["max-links"])
-	if err != nil {
-		return Error, "Failed to parse max-links as a number"
-	}
-	if max <= 0 {
-		return Error, "Failed to parse max-links as a positive number"
+	max := 10
+	if x.Options.MaxLinks > 0 {
+		max = x.Options.MaxLinks
 	}
 
 	//
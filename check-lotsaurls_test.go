@@ -36,7 +36,7 @@ func TestHyperLinkBadCount(t *testing.T) {
 
 	for _, input := range inputs {
 
-		result, detail := checkHyperlinkCounts(Submission{Comment: "Foo, bar", Options: input})
+		result, detail := checkHyperlinkCounts(Submission{Comment: "Foo, bar", Options: parseOptions(input)})
 		if result != Error {
 			t.Errorf("Unexpected response: '%v'", result)
 		}
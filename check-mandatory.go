@@ -7,7 +7,6 @@ package main
 import (
 	"fmt"
 	"reflect"
-	"regexp"
 	"strings"
 )
 
@@ -35,26 +34,10 @@ func validateMandatory(x Submission) (PluginResult, string) {
 	tmp["ip"] = 1
 
 	//
-	// Do we have options?
+	// Add any additional mandatory fields from our options.
 	//
-	if len(x.Options) > 0 {
-
-		//
-		// Split them into an array, based on commas
-		//
-		options := strings.Split(x.Options, ",")
-
-		//
-		// Now look for any additional mandatory fields
-		//
-		for _, option := range options {
-			re := regexp.MustCompile("mandatory=([^=]+)$")
-			match := re.FindStringSubmatch(option)
-
-			if len(match) > 0 {
-				tmp[match[1]] = 1
-			}
-		}
+	for _, field := range x.Options.Mandatory {
+		tmp[field] = 1
 	}
 
 	//
@@ -79,6 +62,11 @@ func validateMandatory(x Submission) (PluginResult, string) {
 			// The specific field
 			f := s.Field(i)
 
+			// Only strings may be mandatory
+			if f.Kind() != reflect.String {
+				continue
+			}
+
 			// The name/value of the field
 			fieldName := typeOfT.Field(i).Name
 			fieldVal := fmt.Sprintf("%s", f.Interface())
@@ -29,7 +29,7 @@ func TestMandatoryOKExtra(t *testing.T) {
 
 	result, _ := validateMandatory(Submission{Site: "example",
 		IP: "1.2.3.4", Comment: "This is a test",
-		Options: "mandatory=agent", Agent: "foo"})
+		Options: parseOptions("mandatory=agent"), Agent: "foo"})
 	if result != Undecided {
 		t.Errorf("Unexpected response: '%v'", result)
 	}
@@ -90,7 +90,7 @@ func TestMandatoryMissingAgent(t *testing.T) {
 
 	result, detail := validateMandatory(Submission{Site: "fsdf",
 		IP:      "1.2.3.4",
-		Options: "mandatory=agent"})
+		Options: parseOptions("mandatory=agent")})
 
 	if result != Spam {
 		t.Errorf("Unexpected response: '%v'", result)
@@ -6,6 +6,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
@@ -18,7 +20,8 @@ func init() {
 	registerPlugin(BlogspamPlugin{Name: "25-requiremx.js",
 		Description: "Validates that an incoming submission has an MX record",
 		Author:      "Steve Kemp <steve@steve.org.uk>",
-		Test:        validateMX,
+		ContextTest: validateMX,
+		Network:     true,
 		RedisCache:  true})
 
 }
@@ -26,7 +29,7 @@ func init() {
 //
 // Test that the email-field is non-empty and contains an MX-record
 //
-func validateMX(x Submission) (PluginResult, string) {
+func validateMX(ctx context.Context, x Submission) (PluginResult, string) {
 
 	//
 	// If we have no email-address we cannot do an MX-lookup.
@@ -49,9 +52,35 @@ func validateMX(x Submission) (PluginResult, string) {
 		//
 		// Lookup the MX-record of the domain.
 		//
-		// We're only looking for an error-here.
+		// We're only looking for an error-here, but we cache
+		// whether there was a record, or not.
 		//
-		_, err := net.LookupMX(match[1])
+		answer, err := cached("mx", match[1], func() (string, error) {
+			_, err := resolver.LookupMX(ctx, match[1])
+			if isNotFound(err) {
+				return "none", nil
+			}
+			return "ok", err
+		})
+		if answer == "none" {
+			err = fmt.Errorf("No MX-record for %s", match[1])
+		}
+
+		//
+		// If we were cancelled we cannot tell.
+		//
+		if ctx.Err() != nil {
+			return Error, ctx.Err().Error()
+		}
+
+		//
+		// Nor can we if the lookup failed, rather than finding
+		// there was no record.
+		//
+		var dnsErr *net.DNSError
+		if err != nil && errors.As(err, &dnsErr) && (dnsErr.IsTemporary || dnsErr.IsTimeout) {
+			return Error, err.Error()
+		}
 
 		if err != nil {
 			return Spam, fmt.Sprintf("Failed to lookup MX-record of %s", match[1])
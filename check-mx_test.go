@@ -5,11 +5,17 @@
 package main
 
 import (
+	"context"
+	"net"
 	"testing"
 )
 
 func TestMXHam(t *testing.T) {
 
+	withResolver(t, &fakeResolver{mx: map[string][]*net.MX{
+		"steve.fi": {{Host: "mail.steve.fi.", Pref: 10}},
+	}})
+
 	//
 	// Test several emails.
 	//
@@ -18,7 +24,7 @@ func TestMXHam(t *testing.T) {
 
 	for _, input := range inputs {
 
-		result, detail := validateMX(Submission{Email: input})
+		result, detail := validateMX(context.Background(), Submission{Email: input})
 		if result != Undecided {
 			t.Errorf("Unexpected response: '%v'", result)
 		}
@@ -30,6 +36,8 @@ func TestMXHam(t *testing.T) {
 
 func TestMXSPAM(t *testing.T) {
 
+	withResolver(t, &fakeResolver{})
+
 	//
 	// Test several emails.
 	//
@@ -38,7 +46,7 @@ func TestMXSPAM(t *testing.T) {
 
 	for _, input := range inputs {
 
-		result, detail := validateMX(Submission{Email: input})
+		result, detail := validateMX(context.Background(), Submission{Email: input})
 		if result != Spam {
 			t.Errorf("Unexpected response: '%v'", result)
 		}
@@ -47,3 +55,19 @@ func TestMXSPAM(t *testing.T) {
 		}
 	}
 }
+
+//
+// A failure to lookup the record is not spam.
+//
+func TestMXFailure(t *testing.T) {
+
+	withResolver(t, &fakeResolver{failures: 1})
+
+	result, detail := validateMX(context.Background(), Submission{Email: "steve@steve.fi"})
+	if result != Error {
+		t.Errorf("Unexpected response: '%v'", result)
+	}
+	if len(detail) == 0 {
+		t.Errorf("Unexpected response: '%v'", detail)
+	}
+}
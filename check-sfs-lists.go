@@ -0,0 +1,434 @@
+//
+//  Check for submitters in the downloadable stopforumspam.com lists.
+//
+//  StopForumSpam publishes lists of the IPs, email addresses, and
+// usernames reported to it, see https://www.stopforumspam.com/downloads
+// for details.  Importing those allows us to test submitters without
+// making a request for each submission.
+//
+//  Lists may be imported into redis with the import-sfs subcommand:
+//
+//    blogspam-api import-sfs -redis localhost:6379 listed_ip_7.zip
+//
+//  Or the server may load them itself, and refresh them periodically,
+// via the `-sfs-lists` flag.  They're stored in redis if available,
+// otherwise in memory.
+//
+//  Each list may be a local file, or a URL, and may be plain text or a
+// zip archive.  The type of the list is taken from its name, which must
+// contain "ip", "email", or "username" as a word of its own, such as
+// "listed_ip_7.zip", unless it is given explicitly.
+//
+//  A list without any valid entries never replaces one we've already
+// loaded, so that a bad download cannot empty it.
+//
+//  Only a listed IP is recorded against the submitter's IP in redis,
+// since the username lists contain many common names.
+//
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis"
+)
+
+//
+// The lists the server loads, and refreshes, itself.
+//
+// This may be changed via the `-sfs-lists` flag.
+//
+var sfsListSources []string
+
+//
+// How often the server refreshes its lists.
+//
+// This may be changed via the `-sfs-lists-refresh` flag.
+//
+var sfsListRefresh = 24 * time.Hour
+
+//
+// The client we use to download lists, which may be large.
+//
+var sfsListClient = &http.Client{
+	Timeout: time.Minute * 5,
+}
+
+//
+// The lists we've loaded into memory, if redis is not available, by
+// type.
+//
+var (
+	sfsLists     = make(map[string]map[string]bool)
+	sfsListsLock sync.RWMutex
+)
+
+//
+// The types of list, in the order we test them, and the fields of a
+// submission they're tested against.
+//
+var sfsListTypes = []string{"ip", "email", "username"}
+
+//
+// Register ourself as a blogspam-plugin.
+//
+func init() {
+	registerPlugin(BlogspamPlugin{Name: "78-sfs-lists.js",
+		Description: "Look for blacklisted IPs, emails, and names in the stopforumspam.com lists",
+		Author:      "Steve Kemp <steve@steve.org.uk>",
+		Test:        checkSFSLists,
+		RedisCache:  true,
+		Cacheable:   sfsCacheable})
+}
+
+//
+// sfsListType returns the type of the given list, from its name.
+//
+// We look for the type as a word of the name, ignoring its extension,
+// since a substring such as "ip" appears in too many names, ".zip" not
+// least.
+//
+func sfsListType(source string) (string, error) {
+
+	name := strings.ToLower(path.Base(source))
+	name = strings.TrimSuffix(name, path.Ext(name))
+
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	var found []string
+	for _, word := range words {
+		for _, kind := range sfsListTypes {
+			if word == kind {
+				found = append(found, kind)
+			}
+		}
+	}
+
+	if len(found) != 1 {
+		return "", fmt.Errorf("cannot tell the type of %s, specify -type", source)
+	}
+	return found[0], nil
+}
+
+//
+// sfsListKey returns the redis-key of the list of the given type.
+//
+func sfsListKey(kind string) string {
+	return fmt.Sprintf("sfs-list-%s", kind)
+}
+
+//
+// normalizeSFSEntry returns the form of the given value we store, and
+// lookup, or "" if it is not valid.
+//
+func normalizeSFSEntry(kind string, value string) string {
+
+	value = strings.TrimSpace(value)
+
+	if kind == "ip" {
+		ip := normalizeIP(value)
+		if ip == nil {
+			return ""
+		}
+		return ip.String()
+	}
+	return strings.ToLower(value)
+}
+
+//
+// readSFSList returns the entries of the given list, which may be a
+// file or URL, containing plain text or a zip archive.
+//
+func readSFSList(source string) ([]string, error) {
+
+	var data []byte
+	var err error
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		var response *http.Response
+		response, err = sfsListClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", source, response.Status)
+		}
+		data, err = ioutil.ReadAll(response.Body)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// If this is a zip archive then read each file within it.
+	//
+	var texts [][]byte
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			text, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return nil, err
+			}
+			texts = append(texts, text)
+		}
+	} else {
+		texts = append(texts, data)
+	}
+
+	//
+	// Each line has an entry, possibly followed by other fields.
+	//
+	var entries []string
+	for _, text := range texts {
+		scanner := bufio.NewScanner(bytes.NewReader(text))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			entries = append(entries, strings.SplitN(line, ",", 2)[0])
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+//
+// storeSFSList replaces the list of the given type.
+//
+// An empty list is refused, leaving the existing list in place.
+//
+func storeSFSList(kind string, entries []string) error {
+
+	if len(entries) == 0 {
+		return fmt.Errorf("no valid %s entries, keeping the existing list", kind)
+	}
+
+	if redisHandle != nil {
+
+		//
+		// Populate a temporary set, and rename it into place, so
+		// that lookups never see a partial list.
+		//
+		key := sfsListKey(kind)
+		temp := key + "-import"
+
+		redisHandle.Del(temp)
+		for start := 0; start < len(entries); start += 10000 {
+			end := start + 10000
+			if end > len(entries) {
+				end = len(entries)
+			}
+
+			members := make([]interface{}, 0, end-start)
+			for _, entry := range entries[start:end] {
+				members = append(members, entry)
+			}
+			err := redisHandle.SAdd(temp, members...).Err()
+			if err != nil {
+				return err
+			}
+		}
+
+		return redisHandle.Rename(temp, key).Err()
+	}
+
+	list := make(map[string]bool)
+	for _, entry := range entries {
+		list[entry] = true
+	}
+
+	sfsListsLock.Lock()
+	sfsLists[kind] = list
+	sfsListsLock.Unlock()
+	return nil
+}
+
+//
+// importSFSList reads the given list, and stores it, returning the
+// number of entries.
+//
+// If the type of the list is empty it is taken from the name of the
+// list.
+//
+func importSFSList(source string, kind string) (int, error) {
+
+	if len(kind) == 0 {
+		var err error
+		kind, err = sfsListType(source)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	entries, err := readSFSList(source)
+	if err != nil {
+		return 0, err
+	}
+
+	var valid []string
+	for _, entry := range entries {
+		if normalized := normalizeSFSEntry(kind, entry); len(normalized) > 0 {
+			valid = append(valid, normalized)
+		}
+	}
+
+	return len(valid), storeSFSList(kind, valid)
+}
+
+//
+// importSFSMain implements the import-sfs subcommand, returning the
+// status to exit with.
+//
+func importSFSMain(args []string) int {
+
+	flags := flag.NewFlagSet("import-sfs", flag.ContinueOnError)
+	rserver := flags.String("redis", "localhost:6379",
+		"The host:port of the redis-server to import into.")
+	kind := flags.String("type", "",
+		"The type of the lists, ip, email, or username, if not clear from their names.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import-sfs [options] file-or-url...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	redisHandle = redis.NewClient(&redis.Options{Addr: *rserver})
+	err := redisHandle.Ping().Err()
+	if err != nil {
+		fmt.Printf("Failed to connect to redis-server %s - %s\n", *rserver, err.Error())
+		return 1
+	}
+
+	for _, source := range flags.Args() {
+		count, err := importSFSList(source, *kind)
+		if err != nil {
+			fmt.Printf("Failed to import %s - %s\n", source, err.Error())
+			return 1
+		}
+		fmt.Printf("Imported %d entries from %s\n", count, source)
+	}
+	return 0
+}
+
+//
+// loadSFSLists loads each of the lists the server was given.
+//
+func loadSFSLists() {
+	for _, source := range sfsListSources {
+		count, err := importSFSList(source, "")
+		if err != nil {
+			fmt.Printf("WARNING - Failed to load %s - %s\n", source, err.Error())
+			continue
+		}
+		fmt.Printf("Loaded %d entries from %s\n", count, source)
+	}
+}
+
+//
+// refreshSFSLists loads the lists the server was given, in the
+// background, and reloads them periodically.
+//
+func refreshSFSLists() {
+
+	if len(sfsListSources) == 0 {
+		return
+	}
+
+	go func() {
+		loadSFSLists()
+
+		if sfsListRefresh <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(sfsListRefresh)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			loadSFSLists()
+		}
+	}()
+}
+
+//
+// Lookup the submitter in the stopforumspam.com lists we've imported.
+//
+func checkSFSLists(x Submission) (PluginResult, string) {
+
+	values := map[string]string{
+		"ip":       normalizeSFSEntry("ip", x.IP),
+		"email":    normalizeSFSEntry("email", x.Email),
+		"username": normalizeSFSEntry("username", x.Name),
+	}
+	names := map[string]string{"ip": "IP", "email": "Email", "username": "Name"}
+
+	if redisHandle != nil {
+		pipe := redisHandle.Pipeline()
+		found := make(map[string]*redis.BoolCmd)
+		for _, kind := range sfsListTypes {
+			if len(values[kind]) > 0 {
+				found[kind] = pipe.SIsMember(sfsListKey(kind), values[kind])
+			}
+		}
+		_, err := pipe.Exec()
+		if err != nil {
+			return Error, err.Error()
+		}
+
+		for _, kind := range sfsListTypes {
+			if cmd, ok := found[kind]; ok && cmd.Val() {
+				return Spam, fmt.Sprintf("%s listed in StopForumSpam.com lists", names[kind])
+			}
+		}
+		return Undecided, ""
+	}
+
+	sfsListsLock.RLock()
+	defer sfsListsLock.RUnlock()
+
+	for _, kind := range sfsListTypes {
+		if len(values[kind]) > 0 && sfsLists[kind][values[kind]] {
+			return Spam, fmt.Sprintf("%s listed in StopForumSpam.com lists", names[kind])
+		}
+	}
+	return Undecided, ""
+}
@@ -0,0 +1,229 @@
+//
+// Test for our stopforumspam.com-lists plugin.
+//
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// withSFSLists clears the lists loaded in memory, for the duration of a
+// test, returning a directory to write lists within.
+//
+func withSFSLists(t *testing.T) string {
+
+	saved := sfsLists
+
+	sfsListsLock.Lock()
+	sfsLists = make(map[string]map[string]bool)
+	sfsListsLock.Unlock()
+
+	t.Cleanup(func() {
+		sfsListsLock.Lock()
+		sfsLists = saved
+		sfsListsLock.Unlock()
+	})
+
+	dir, err := ioutil.TempDir("", "sfs-lists")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+//
+// zipped returns a zip archive containing the given text.
+//
+func zipped(t *testing.T, name string, text string) []byte {
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	file, err := archive.Create(name)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %s", err.Error())
+	}
+	file.Write([]byte(text))
+
+	err = archive.Close()
+	if err != nil {
+		t.Fatalf("Failed to create archive: %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+//
+// The type of a list is taken from its name.
+//
+func TestSFSListType(t *testing.T) {
+
+	tests := map[string]string{
+		"listed_ip_7.zip":                         "ip",
+		"/tmp/listed_email_30.txt":                "email",
+		"https://example.com/listed_username.zip": "username",
+		"listed_ip_7_ipv46.gz":                    "ip",
+		"whatever.txt":                            "",
+		"spammers.zip":                            "",
+		"https://example.com/zipped/list.txt":     "",
+		"listed_email_ip.txt":                     "",
+	}
+
+	for source, expected := range tests {
+		kind, err := sfsListType(source)
+		if kind != expected {
+			t.Errorf("Unexpected type for %s: '%s'", source, kind)
+		}
+		if len(expected) == 0 && err == nil {
+			t.Errorf("Expected an error for %s", source)
+		}
+	}
+}
+
+//
+// Plain text lists are imported, ignoring bogus entries.
+//
+func TestSFSListsText(t *testing.T) {
+
+	dir := withSFSLists(t)
+
+	path := filepath.Join(dir, "listed_ip_7.txt")
+	ioutil.WriteFile(path, []byte("1.2.3.4\n\n# comment\n2001:DB8::1,5,2019-01-01\nbogus\n"), 0644)
+
+	count, err := importSFSList(path, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if count != 2 {
+		t.Errorf("Unexpected count: %d", count)
+	}
+
+	tests := map[string]PluginResult{
+		"1.2.3.4":          Spam,
+		"::ffff:1.2.3.4":   Spam,
+		"2001:db8::1":      Spam,
+		"1.2.3.5":          Undecided,
+		"bogus":            Undecided,
+		"":                 Undecided,
+		"2001:db8:0:0::1":  Spam,
+		"2001:db8:0:0::10": Undecided,
+	}
+
+	for ip, expected := range tests {
+		result, detail := checkSFSLists(Submission{IP: ip})
+		if result != expected {
+			t.Errorf("Unexpected result for '%s': %v %s", ip, result, detail)
+		}
+	}
+}
+
+//
+// Zipped lists are imported, and may be fetched via HTTP.
+//
+func TestSFSListsZip(t *testing.T) {
+
+	withSFSLists(t)
+
+	emails := zipped(t, "listed_email_7.txt", "Spammer@Example.com\n")
+	names := zipped(t, "listed_username_7.txt", "spammer\n")
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.Contains(req.URL.Path, "email"):
+			res.Write(emails)
+		case strings.Contains(req.URL.Path, "username"):
+			res.Write(names)
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+	defer server.Close()
+
+	saved := sfsListSources
+	sfsListSources = []string{
+		server.URL + "/listed_email_7.zip",
+		server.URL + "/listed_username_7.zip",
+		server.URL + "/listed_ip_7.zip",
+	}
+	defer func() { sfsListSources = saved }()
+
+	loadSFSLists()
+
+	result, detail := checkSFSLists(Submission{Email: "spammer@example.com"})
+	if result != Spam || detail != "Email listed in StopForumSpam.com lists" {
+		t.Errorf("Unexpected result: %v %s", result, detail)
+	}
+
+	result, detail = checkSFSLists(Submission{Name: "SPAMMER"})
+	if result != Spam || detail != "Name listed in StopForumSpam.com lists" {
+		t.Errorf("Unexpected result: %v %s", result, detail)
+	}
+
+	result, _ = checkSFSLists(Submission{Name: "steve", Email: "steve@example.com"})
+	if result != Undecided {
+		t.Errorf("Unexpected result: %v", result)
+	}
+
+	//
+	// A listed name isn't recorded against the submitter's IP.
+	//
+	for _, obj := range plugins {
+		if obj.Name == "78-sfs-lists.js" && obj.caches(detail) {
+			t.Errorf("A listed name was cached: %s", detail)
+		}
+	}
+
+	//
+	// The missing list is an error.
+	//
+	_, err := importSFSList(server.URL+"/listed_ip_7.zip", "")
+	if err == nil {
+		t.Errorf("Expected an error importing a missing list")
+	}
+}
+
+//
+// A list without valid entries doesn't replace the existing one.
+//
+func TestSFSListsEmpty(t *testing.T) {
+
+	dir := withSFSLists(t)
+
+	path := filepath.Join(dir, "listed_ip_7.txt")
+	ioutil.WriteFile(path, []byte("1.2.3.4\n"), 0644)
+
+	_, err := importSFSList(path, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	//
+	// A list of the wrong type, or an empty one, is refused.
+	//
+	ioutil.WriteFile(path, []byte("spammer@example.com\n"), 0644)
+	_, err = importSFSList(path, "")
+	if err == nil {
+		t.Errorf("Expected an error importing a list without valid entries")
+	}
+
+	ioutil.WriteFile(path, []byte(""), 0644)
+	_, err = importSFSList(path, "")
+	if err == nil {
+		t.Errorf("Expected an error importing an empty list")
+	}
+
+	result, _ := checkSFSLists(Submission{IP: "1.2.3.4"})
+	if result != Spam {
+		t.Errorf("The existing list was replaced")
+	}
+}
@@ -1,15 +1,35 @@
 //
-//  Check for an IP that is in the stopforumspam.com blacklist.
+//  Check for submitters who are in the stopforumspam.com blacklist.
+//
+//  We lookup the IP address, email address, and name of the submitter
+// via the JSON API, which tells us how often each has been reported,
+// when they were last reported, and how confident StopForumSpam is
+// that they're a spammer:
+//
+//    {"success": 1,
+//     "ip": {"appears": 1, "frequency": 255, "confidence": 99.95,
+//            "lastseen": "2019-03-01 12:34:56"}}
+//
+//  A submission is only SPAM if one of them has been reported often
+// enough, recently enough, and with enough confidence.
+//
+//  Only a listed IP is recorded against the submitter's IP in redis,
+// since common names, and shared emails, are listed too.
 //
 
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,71 +38,259 @@ import (
 //
 func init() {
 	registerPlugin(BlogspamPlugin{Name: "80-sfs.js",
-		Description: "Look for blacklisted IPs via stopforumspam.com",
+		Description: "Look for blacklisted IPs, emails, and names via stopforumspam.com",
 		Author:      "Steve Kemp <steve@steve.org.uk>",
-		Test:        checkSFSBlacklist,
-		RedisCache:  true})
+		ContextTest: checkSFSBlacklist,
+		Network:     true,
+		RedisCache:  true,
+		Cacheable:   sfsCacheable})
 }
 
 //
-// Lookup the IP address of the submitter in the stopforumspam.com blacklist.
+// The API end-point we query.
+//
+// This may be changed via the `-sfs-url` flag.
 //
-func checkSFSBlacklist(x Submission) (PluginResult, string) {
+var sfsURL = "https://api.stopforumspam.org/api"
 
-	//
-	// See if we have an IPv4 address.
-	//
-	regex := regexp.MustCompile("^([0-9]+).([0-9]+).([0-9]+).([0-9]+)$")
-	match := regex.FindStringSubmatch(x.IP)
+//
+// The number of times an entry must have been reported.
+//
+// This may be changed via the `-sfs-frequency` flag.
+//
+var sfsFrequency = 2
 
-	//
-	// If that failed then we know we have an IPv6-address, or a missing
-	// address, so we terminate
-	//
-	if len(match) <= 0 {
-		return Undecided, ""
+//
+// The confidence, as a percentage, StopForumSpam must have that an
+// entry is a spammer.
+//
+// This may be changed via the `-sfs-confidence` flag.
+//
+var sfsConfidence = 50.0
+
+//
+// How recently an entry must have been reported, zero for any time.
+//
+// This may be changed via the `-sfs-max-age` flag.
+//
+var sfsMaxAge = 90 * 24 * time.Hour
+
+//
+// The client we use to make requests.
+//
+// The timeout here is a backstop, requests are also bound to the
+// context of the incoming submission.
+//
+var sfsClient = &http.Client{
+	Timeout: time.Second * 10,
+}
+
+//
+// sfsEntry is the result of looking up a single field.
+//
+type sfsEntry struct {
+	Appears    int
+	Frequency  int
+	Confidence float64
+	LastSeen   string
+}
+
+//
+// sfsResponse is the response of the API.
+//
+type sfsResponse struct {
+	Success  int
+	Error    string
+	IP       *sfsEntry
+	Email    *sfsEntry
+	Username *sfsEntry
+}
+
+//
+// blocked returns true if the entry exceeds our thresholds.
+//
+func (e *sfsEntry) blocked(now time.Time) bool {
+
+	if e == nil || e.Appears == 0 {
+		return false
+	}
+	if e.Frequency < sfsFrequency || e.Confidence < sfsConfidence {
+		return false
+	}
+
+	if sfsMaxAge > 0 {
+		seen, err := time.Parse("2006-01-02 15:04:05", e.LastSeen)
+		if err != nil || now.Sub(seen) > sfsMaxAge {
+			return false
+		}
 	}
+	return true
+}
+
+//
+// sfsField is a field of a submission which we lookup.
+//
+type sfsField struct {
+	name  string
+	param string
+	value string
+}
+
+//
+// sfsFields returns the fields of the given submission we lookup.
+//
+func sfsFields(x Submission) []sfsField {
+
+	var ret []sfsField
 
 	//
-	// Build a client with sane timeout
+	// The address may be IPv4 or IPv6, and is ignored if bogus.
 	//
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
+	if ip := normalizeIP(x.IP); ip != nil {
+		ret = append(ret, sfsField{"IP", "ip", ip.String()})
 	}
+	if len(x.Email) > 0 {
+		ret = append(ret, sfsField{"Email", "email", x.Email})
+	}
+	if len(x.Name) > 0 {
+		ret = append(ret, sfsField{"Name", "username", x.Name})
+	}
+	return ret
+}
+
+//
+// sfsCacheable returns true if the given detail is due to the IP of the
+// submitter, rather than their email or name, and so may be recorded
+// against that IP.
+//
+func sfsCacheable(detail string) bool {
+	return strings.HasPrefix(detail, "IP ")
+}
+
+//
+// sfsLookup returns the entry for the given field value.
+//
+// Each field is cached separately, so that submissions from the same
+// IP share an answer whatever their name.  The cache is keyed by a
+// hash of the value, so that we don't store emails and names in the
+// names of keys.
+//
+func sfsLookup(ctx context.Context, field sfsField) (*sfsEntry, error) {
+
+	query := url.Values{}
+	query.Set(field.param, field.value)
+	query.Set("json", "")
 
 	//
 	// The URL we'll fetch
 	//
-	url := fmt.Sprintf("http://www.stopforumspam.com/api?ip=%s", x.IP)
+	endpoint := sfsURL + "?" + query.Encode()
 
 	//
-	// Make the request
+	// Make the request, unless we've cached the response.
 	//
-	response, err := netClient.Get(url)
+	key := fmt.Sprintf("%s-%x", field.param, sha256.Sum256([]byte(field.value)))
+
+	contents, err := cached("sfs", key, func() (string, error) {
+		request, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		if err != nil {
+			return "", err
+		}
+		response, err := sfsClient.Do(request)
+
+		//
+		// Handle error
+		//
+		if err != nil {
+			fmt.Printf("WARNING: HTTP-Error reading from %s - %s\n", endpoint, err)
+			return "", err
+		}
+
+		//
+		// Ensure we close the body
+		//
+		defer response.Body.Close()
+		contents, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			fmt.Printf("WARNING: HTTP-Error reading body from %s - %s\n", endpoint, err)
+			return "", err
+		}
+		if response.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Unexpected status from StopForumSpam - %s", response.Status)
+		}
+
+		//
+		// Only cache responses we can understand.
+		//
+		var parsed sfsResponse
+		err = json.Unmarshal(contents, &parsed)
+		if err != nil {
+			return "", err
+		}
+		if parsed.Success != 1 {
+			return "", errors.New("StopForumSpam lookup failed - " + parsed.Error)
+		}
+
+		entry := parsed.IP
+		switch field.param {
+		case "email":
+			entry = parsed.Email
+		case "username":
+			entry = parsed.Username
+		}
+		out, err := json.Marshal(entry)
+		return string(out), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entry *sfsEntry
+	err = json.Unmarshal([]byte(contents), &entry)
+	return entry, err
+}
+
+//
+// Lookup the submitter in the stopforumspam.com blacklist.
+//
+func checkSFSBlacklist(ctx context.Context, x Submission) (PluginResult, string) {
+
+	fields := sfsFields(x)
 
 	//
-	// Handle error
+	// Lookup each field concurrently.
 	//
-	if err != nil {
-		fmt.Printf("WARNING: HTTP-Error reading from %s - %s", url, err)
-		return Error, err.Error()
+	entries := make([]*sfsEntry, len(fields))
+	errs := make([]error, len(fields))
+
+	var wg sync.WaitGroup
+	for i, field := range fields {
+		wg.Add(1)
+		go func(i int, field sfsField) {
+			defer wg.Done()
+			entries[i], errs[i] = sfsLookup(ctx, field)
+		}(i, field)
 	}
+	wg.Wait()
 
 	//
-	// Ensure we close the body
+	// Does any field appear?
 	//
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		fmt.Printf("WARNING: HTTP-Error reading body from %s - %s", url, err)
-		return Error, err.Error()
+	now := time.Now()
+	for i, field := range fields {
+		if entries[i].blocked(now) {
+			return Spam, fmt.Sprintf("%s listed in StopForumSpam.com (frequency %d, confidence %.2f%%)",
+				field.name, entries[i].Frequency, entries[i].Confidence)
+		}
 	}
 
 	//
-	// Does it appear?
+	// If we couldn't lookup a field we cannot say.
 	//
-	if strings.Contains(string(contents), "<appears>yes</appears>") {
-		return Spam, "Listed in StopForumSpam.com"
+	for _, err := range errs {
+		if err != nil {
+			return Error, err.Error()
+		}
 	}
 
 	//
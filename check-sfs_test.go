@@ -5,14 +5,60 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
+//
+// withSFS answers StopForumSpam queries, for the duration of a test,
+// with the given entries for each field value.
+//
+func withSFS(t *testing.T, entries map[string]string) *int {
+
+	queries := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		queries++
+
+		var fields []string
+		for _, field := range []string{"ip", "email", "username"} {
+			value := req.URL.Query().Get(field)
+			if len(value) == 0 {
+				continue
+			}
+			entry, ok := entries[value]
+			if !ok {
+				entry = `{"appears":0,"frequency":0}`
+			}
+			fields = append(fields, fmt.Sprintf("%q:%s", field, entry))
+		}
+		fmt.Fprintf(res, `{"success":1,%s}`, strings.Join(fields, ","))
+	}))
+
+	saved := sfsURL
+	sfsURL = server.URL + "/api"
+	resetCache()
+
+	t.Cleanup(func() {
+		server.Close()
+		sfsURL = saved
+		resetCache()
+	})
+	return &queries
+}
+
 //
 // Test IPs that should never be listed.
 //
 func TestNonSpammer(t *testing.T) {
 
+	queries := withSFS(t, nil)
+
 	//
 	// Test several IPs
 	//
@@ -20,7 +66,7 @@ func TestNonSpammer(t *testing.T) {
 
 	for _, input := range inputs {
 
-		result, detail := checkSFSBlacklist(Submission{IP: input})
+		result, detail := checkSFSBlacklist(context.Background(), Submission{IP: input})
 
 		if result != Undecided {
 			t.Errorf("Unexpected response: '%v'", result)
@@ -29,19 +75,135 @@ func TestNonSpammer(t *testing.T) {
 			t.Errorf("Unexpected response: '%v'", detail)
 		}
 	}
+
+	//
+	// The bogus address wasn't looked up.
+	//
+	if *queries != 2 {
+		t.Errorf("Unexpected number of queries: %d", *queries)
+	}
 }
 
 //
-// Test a known-bad IP
+// Test known-bad fields.
 //
 func TestSFSListed(t *testing.T) {
 
-	result, detail := checkSFSBlacklist(Submission{IP: "37.115.125.139"})
+	recent := time.Now().Add(-time.Hour).UTC().Format("2006-01-02 15:04:05")
+
+	withSFS(t, map[string]string{
+		"37.115.125.139":      `{"appears":1,"frequency":255,"confidence":99.95,"lastseen":"` + recent + `"}`,
+		"spammer@example.com": `{"appears":1,"frequency":10,"confidence":80,"lastseen":"` + recent + `"}`,
+		"Spammer":             `{"appears":1,"frequency":10,"confidence":80,"lastseen":"` + recent + `"}`,
+	})
+
+	type TestCase struct {
+		Input    Submission
+		Expected string
+	}
+
+	tests := []TestCase{
+		{Submission{IP: "37.115.125.139"}, "IP listed"},
+		{Submission{IP: "::ffff:37.115.125.139"}, "IP listed"},
+		{Submission{IP: "10.0.0.1", Email: "spammer@example.com"}, "Email listed"},
+		{Submission{Name: "Spammer"}, "Name listed"},
+	}
+
+	for _, test := range tests {
+		result, detail := checkSFSBlacklist(context.Background(), test.Input)
+
+		if result != Spam {
+			t.Errorf("Unexpected response for %v: '%v'", test.Input, result)
+		}
+		if !strings.Contains(detail, test.Expected) {
+			t.Errorf("Unexpected response for %v: '%v'", test.Input, detail)
+		}
+	}
+}
+
+//
+// Test that entries must exceed our thresholds.
+//
+func TestSFSThresholds(t *testing.T) {
+
+	recent := time.Now().Add(-time.Hour).UTC().Format("2006-01-02 15:04:05")
+
+	withSFS(t, map[string]string{
+		"10.0.0.1": `{"appears":1,"frequency":1,"confidence":99,"lastseen":"` + recent + `"}`,
+		"10.0.0.2": `{"appears":1,"frequency":50,"confidence":10,"lastseen":"` + recent + `"}`,
+		"10.0.0.3": `{"appears":1,"frequency":50,"confidence":99,"lastseen":"2001-01-01 00:00:00"}`,
+	})
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		result, detail := checkSFSBlacklist(context.Background(), Submission{IP: ip})
+		if result != Undecided {
+			t.Errorf("Unexpected response for %s: '%v' '%v'", ip, result, detail)
+		}
+	}
+
+	saved := sfsMaxAge
+	sfsMaxAge = 0
+	defer func() { sfsMaxAge = saved }()
 
+	resetCache()
+	result, _ := checkSFSBlacklist(context.Background(), Submission{IP: "10.0.0.3"})
 	if result != Spam {
-		t.Errorf("Unexpected response: '%v'", result)
+		t.Errorf("Unexpected response without a maximum age: '%v'", result)
 	}
-	if len(detail) == 0 {
-		t.Errorf("Unexpected response: '%v'", detail)
+}
+
+//
+// Test that failures are errors, and aren't cached.
+//
+func TestSFSFailure(t *testing.T) {
+
+	queries := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		queries++
+		fmt.Fprintf(res, `{"success":0,"error":"rate limit exceeded"}`)
+	}))
+	defer server.Close()
+
+	saved := sfsURL
+	sfsURL = server.URL
+	defer func() { sfsURL = saved }()
+	resetCache()
+
+	for i := 0; i < 2; i++ {
+		result, detail := checkSFSBlacklist(context.Background(), Submission{IP: "10.0.0.1"})
+		if result != Error || !strings.Contains(detail, "rate limit") {
+			t.Errorf("Unexpected response: '%v' '%v'", result, detail)
+		}
+	}
+	if queries != 2 {
+		t.Errorf("Unexpected number of queries: %d", queries)
+	}
+}
+
+//
+// Test that each field is cached separately, and that only a listed IP
+// is recorded against the submitter.
+//
+func TestSFSCache(t *testing.T) {
+
+	queries := withSFS(t, nil)
+
+	checkSFSBlacklist(context.Background(), Submission{IP: "10.0.0.1", Name: "Steve"})
+	checkSFSBlacklist(context.Background(), Submission{IP: "10.0.0.1", Name: "Bob"})
+
+	if *queries != 3 {
+		t.Errorf("Unexpected number of queries: %d", *queries)
+	}
+
+	for _, obj := range plugins {
+		if obj.Name != "80-sfs.js" {
+			continue
+		}
+		if !obj.caches("IP listed in StopForumSpam.com (frequency 10, confidence 80.00%)") {
+			t.Errorf("A listed IP was not cached")
+		}
+		if obj.caches("Name listed in StopForumSpam.com (frequency 10, confidence 80.00%)") {
+			t.Errorf("A listed name was cached")
+		}
 	}
 }
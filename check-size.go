@@ -6,9 +6,6 @@ package main
 
 import (
 	"fmt"
-	"regexp"
-	"strconv"
-	"strings"
 )
 
 //
@@ -28,65 +25,29 @@ func init() {
 func validateSize(x Submission) (PluginResult, string) {
 
 	//
-	// Map to store any options we find.
+	// Were either of the options bogus?
 	//
-	tmp := make(map[string]string)
-
-	//
-	// Do we have options?
-	//
-	if len(x.Options) > 0 {
-
-		//
-		// Split the string into an array, based on commas
-		//
-		options := strings.Split(x.Options, ",")
-
-		//
-		// Now look for key=val
-		//
-		for _, option := range options {
-			re := regexp.MustCompile("^(.*)=([^=]+)$")
-			match := re.FindStringSubmatch(option)
-
-			if len(match) > 0 {
-				tmp[match[1]] = match[2]
-			}
+	for _, key := range []string{"min-size", "max-size"} {
+		if detail, ok := x.Options.Invalid[key]; ok {
+			return Error, detail
 		}
 	}
 
 	//
 	// Do we have a min-size?
 	//
-	if len(tmp["min-size"]) > 0 {
-		i, err := strconv.Atoi(tmp["min-size"])
-		if err != nil {
-			return Error, "Failed to parse max-size as a number"
-
-		}
-		if i <= 0 {
-			return Error, "Failed to parse max-size as a positive number"
-		}
-
-		if len(x.Comment) < i {
-			return Spam, fmt.Sprintf("Comment size is %d which is less than the minimum size %s", len(x.Comment), tmp["min-size"])
+	if x.Options.MinSize > 0 {
+		if len(x.Comment) < x.Options.MinSize {
+			return Spam, fmt.Sprintf("Comment size is %d which is less than the minimum size %d", len(x.Comment), x.Options.MinSize)
 		}
 	}
 
 	//
 	// Do we have a max-size?
 	//
-	if len(tmp["max-size"]) > 0 {
-		i, err := strconv.Atoi(tmp["max-size"])
-		if err != nil {
-			return Error, "Failed to parse max-size as a number"
-		}
-		if i <= 0 {
-			return Error, "Failed to parse max-size as a positive number"
-		}
-
-		if len(x.Comment) > i {
-			return Spam, fmt.Sprintf("Comment size is %d which is more than the maximum size %s", len(x.Comment), tmp["min-size"])
+	if x.Options.MaxSize > 0 {
+		if len(x.Comment) > x.Options.MaxSize {
+			return Spam, fmt.Sprintf("Comment size is %d which is more than the maximum size %d", len(x.Comment), x.Options.MaxSize)
 		}
 	}
 
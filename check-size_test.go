@@ -15,7 +15,7 @@ func TestSizeHam(t *testing.T) {
 	// Test a simple comment.
 	//
 	result, detail := validateEmail(Submission{Comment: "I like to eat cakes",
-		Options: "min-size=1,max-size=100"})
+		Options: parseOptions("min-size=1,max-size=100")})
 	if result != Undecided {
 		t.Errorf("Unexpected response: '%v'", result)
 	}
@@ -39,7 +39,7 @@ func TestSizeBrokenOptions(t *testing.T) {
 
 	for _, input := range inputs {
 
-		result, detail := validateSize(Submission{Comment: "Foo, bar", Options: input})
+		result, detail := validateSize(Submission{Comment: "Foo, bar", Options: parseOptions(input)})
 		if result != Error {
 			t.Errorf("Unexpected response '%v'", result)
 		}
@@ -66,7 +66,7 @@ func TestSizeTooSmall(t *testing.T) {
 	for _, input := range inputs {
 
 		result, detail := validateSize(Submission{Comment: input,
-			Options: "min-size=100"})
+			Options: parseOptions("min-size=100")})
 		if result != Spam {
 			t.Errorf("Unexpected response: '%v'", result)
 		}
@@ -93,7 +93,7 @@ func TestSizeTooLarge(t *testing.T) {
 	for _, input := range inputs {
 
 		result, detail := validateSize(Submission{Comment: input,
-			Options: "max-size=10"})
+			Options: parseOptions("max-size=10")})
 		if result != Spam {
 			t.Errorf("Unexpected response: '%v'", result)
 		}
@@ -0,0 +1,215 @@
+//
+//  Look for submitters posting too many comments, too quickly.
+//
+//  We record the time of every submission against both the IP address
+// of the submitter and the network it belongs to, a /24 for IPv4 and a
+// /64 for IPv6.  If either has made more than the permitted number of
+// submissions within the window, across all sites, the submission is
+// SPAM.
+//
+//  The times are stored in redis, if available, so that they're shared
+// between servers.  Otherwise they're stored in memory.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//
+// The window over which we count submissions.
+//
+// This may be changed via the `-velocity-window` flag.
+//
+var velocityWindow = time.Minute
+
+//
+// The number of submissions permitted from a single IP within our
+// window, zero to disable.
+//
+// This may be changed via the `-velocity-ip` flag.
+//
+var velocityIPLimit = 30
+
+//
+// The number of submissions permitted from a single network within
+// our window, zero to disable.
+//
+// This may be changed via the `-velocity-network` flag.
+//
+var velocityNetworkLimit = 100
+
+//
+// The times of recent submissions, by key, if redis is not available,
+// and when we last dropped the keys which had expired.
+//
+var (
+	velocityTimes = make(map[string][]time.Time)
+	velocitySwept time.Time
+	velocityLock  sync.Mutex
+)
+
+//
+// A counter used to ensure each submission we store in redis is unique.
+//
+var velocitySequence uint64
+
+//
+// Register ourself as a blogspam-plugin.
+//
+func init() {
+	registerPlugin(BlogspamPlugin{Name: "15-velocity.js",
+		Description: "Look for submitters posting too many comments, too quickly.",
+		Author:      "Steve Kemp <steve@steve.org.uk>",
+		ContextTest: checkVelocity})
+}
+
+//
+// velocityNetwork returns the network the given IP belongs to, or ""
+// if it cannot be parsed.
+//
+func velocityNetwork(ip string) string {
+
+	parsed := normalizeIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		network := net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		return network.String()
+	}
+
+	network := net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return network.String()
+}
+
+//
+// velocityRecord records a submission against the given key, and
+// returns the number of submissions made within our window.
+//
+// If record is false the submission is counted, but not recorded.
+//
+func velocityRecord(key string, now time.Time, record bool) (int64, error) {
+
+	cutoff := now.Add(-velocityWindow)
+
+	if redisHandle != nil {
+		key = fmt.Sprintf("velocity-%s", key)
+
+		if !record {
+			count, err := redisHandle.ZCount(key, "("+strconv.FormatInt(cutoff.UnixNano(), 10), "+inf").Result()
+			return count + 1, err
+		}
+		member := fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddUint64(&velocitySequence, 1))
+
+		pipe := redisHandle.TxPipeline()
+		pipe.ZRemRangeByScore(key, "-inf", strconv.FormatInt(cutoff.UnixNano(), 10))
+		pipe.ZAdd(key, redis.Z{Score: float64(now.UnixNano()), Member: member})
+		count := pipe.ZCard(key)
+		pipe.Expire(key, velocityWindow)
+		_, err := pipe.Exec()
+		if err != nil {
+			return 0, err
+		}
+		return count.Val(), nil
+	}
+
+	velocityLock.Lock()
+	defer velocityLock.Unlock()
+
+	//
+	// Drop any times outside our window, and add this one.
+	//
+	var times []time.Time
+	for _, t := range velocityTimes[key] {
+		if t.After(cutoff) {
+			times = append(times, t)
+		}
+	}
+	times = append(times, now)
+
+	if !record {
+		return int64(len(times)), nil
+	}
+	velocityTimes[key] = times
+
+	//
+	// Drop any other keys which have expired entirely, so that we
+	// don't grow without bound.  This is proportional to the number
+	// of submitters, so we only do it once per window.
+	//
+	if now.Sub(velocitySwept) >= velocityWindow {
+		velocitySwept = now
+		for other, list := range velocityTimes {
+			if !list[len(list)-1].After(cutoff) {
+				delete(velocityTimes, other)
+			}
+		}
+	}
+
+	return int64(len(times)), nil
+}
+
+//
+// Test that the submitter isn't posting too quickly.
+//
+func checkVelocity(ctx context.Context, x Submission) (PluginResult, string) {
+
+	network := velocityNetwork(x.IP)
+	if len(network) == 0 {
+		return Undecided, ""
+	}
+
+	//
+	// The same address may be written in several ways.
+	//
+	ip := normalizeIP(x.IP).String()
+
+	now := time.Now()
+
+	type limit struct {
+		key   string
+		name  string
+		limit int
+	}
+
+	limits := []limit{
+		{"ip-" + ip, "IP " + ip, velocityIPLimit},
+		{"net-" + network, "network " + network, velocityNetworkLimit},
+	}
+
+	//
+	// Record the submission against each, before we test any, so
+	// that the counts are complete.
+	//
+	counts := make([]int64, len(limits))
+	for i, l := range limits {
+		if l.limit <= 0 {
+			continue
+		}
+
+		count, err := velocityRecord(l.key, now, !isDryRun(ctx))
+		if err != nil {
+			return Error, err.Error()
+		}
+		counts[i] = count
+	}
+
+	for i, l := range limits {
+		if l.limit > 0 && counts[i] > int64(l.limit) {
+			return Spam, fmt.Sprintf("%d submissions from %s within %s", counts[i], l.name, velocityWindow)
+		}
+	}
+
+	return Undecided, ""
+}
@@ -0,0 +1,95 @@
+//
+// Test for our velocity-plugin.
+//
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+//
+// Test the networks we group IPs into.
+//
+func TestVelocityNetwork(t *testing.T) {
+
+	inputs := map[string]string{
+		"10.20.30.40":          "10.20.30.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"bogus":                "",
+	}
+
+	for input, expected := range inputs {
+		if output := velocityNetwork(input); output != expected {
+			t.Errorf("Unexpected network for %s: %s", input, output)
+		}
+	}
+}
+
+//
+// Test that too many submissions from an IP, or a network, are spam.
+//
+func TestVelocity(t *testing.T) {
+
+	savedIP, savedNet := velocityIPLimit, velocityNetworkLimit
+	velocityIPLimit, velocityNetworkLimit = 3, 4
+	defer func() {
+		velocityIPLimit, velocityNetworkLimit = savedIP, savedNet
+	}()
+
+	for i := 0; i < 3; i++ {
+		result, detail := checkVelocity(context.Background(), Submission{IP: "192.0.2.1"})
+		if result != Undecided {
+			t.Errorf("Unexpected result for submission %d: %v %s", i, result, detail)
+		}
+	}
+
+	result, detail := checkVelocity(context.Background(), Submission{IP: "192.0.2.1"})
+	if result != Spam || !strings.Contains(detail, "IP 192.0.2.1") {
+		t.Errorf("Unexpected result: %v %s", result, detail)
+	}
+
+	//
+	// Another IP in the same network is fine, until the network
+	// has also made too many submissions.
+	//
+	result, _ = checkVelocity(context.Background(), Submission{IP: "192.0.2.2"})
+	if result != Spam {
+		t.Errorf("Unexpected result: %v", result)
+	}
+
+	//
+	// Another network is unaffected.
+	//
+	result, _ = checkVelocity(context.Background(), Submission{IP: "198.51.100.1"})
+	if result != Undecided {
+		t.Errorf("Unexpected result: %v", result)
+	}
+
+	//
+	// The same address written differently is the same IP.
+	//
+	for i, ip := range []string{"2001:db8::1", "2001:DB8:0::1", "2001:0db8::0001"} {
+		result, _ = checkVelocity(context.Background(), Submission{IP: ip})
+		if result != Undecided {
+			t.Errorf("Unexpected result for submission %d: %v", i, result)
+		}
+	}
+	result, detail = checkVelocity(context.Background(), Submission{IP: "2001:db8::1"})
+	if result != Spam || !strings.Contains(detail, "IP 2001:db8::1") {
+		t.Errorf("Unexpected result: %v %s", result, detail)
+	}
+
+	result, detail = checkVelocity(context.Background(), Submission{IP: "::ffff:198.51.100.1"})
+	if result != Undecided || len(detail) != 0 {
+		t.Errorf("Unexpected result: %v %s", result, detail)
+	}
+	velocityLock.Lock()
+	count := len(velocityTimes["ip-198.51.100.1"])
+	velocityLock.Unlock()
+	if count != 2 {
+		t.Errorf("Unexpected count for a mapped IPv4 address: %d", count)
+	}
+}
@@ -0,0 +1,255 @@
+//
+//  Logging of our decisions.
+//
+//  If enabled, via the `-decision-log` flag, we write a single line of
+// JSON for each submission we test, whether it was SPAM or not:
+//
+//    {"time": "2019-03-01T12:34:56Z", "request-id": "4f1c2a9b0d3e8f71",
+//     "site": "https://example.com/", "ip": "1.2.3.4",
+//     "result": "SPAM", "blocker": "80-sfs.js", "reason": "...",
+//     "time-ms": 12.5, "fields": {"name": "...", ...},
+//     "plugins": [{"plugin": "00-example.js", "result": "Undecided", ...}]}
+//
+//  The log may be written to a file, which is rotated once it reaches
+// a given size, to STDOUT, via "-", or to syslog, via "syslog".
+//
+//  Every request is given an ID, which is returned to the caller in the
+// X-Request-ID header, so that a decision may be found in the log.  If
+// the caller supplies an X-Request-ID of its own that is used instead.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// The log we write our decisions to, if any.
+//
+// This may be changed via the `-decision-log` flag.
+//
+var (
+	decisionLog     io.Writer
+	decisionLogLock sync.Mutex
+)
+
+//
+// The type of the context-key beneath which we store the ID of a
+// request.
+//
+type requestIDContextKey struct{}
+
+//
+// openDecisionLog returns the writer for the given target, which may
+// be "-" for STDOUT, "syslog", or the path to a file.
+//
+// Files are rotated once they would exceed the given size, in bytes,
+// and the given number of old files are kept.  A size of zero disables
+// rotation.
+//
+func openDecisionLog(target string, size int64, keep int) (io.Writer, error) {
+
+	switch target {
+	case "":
+		return nil, nil
+	case "-", "stdout":
+		return os.Stdout, nil
+	case "syslog":
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "blogspam-api")
+	}
+
+	r := &rotatingFile{path: target, size: size, keep: keep}
+	return r, r.open()
+}
+
+//
+// rotatingFile is a file which is rotated once it reaches a given size.
+//
+type rotatingFile struct {
+	path    string
+	size    int64
+	keep    int
+	file    *os.File
+	written int64
+}
+
+//
+// open opens the file for appending.
+//
+func (r *rotatingFile) open() error {
+
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.written = info.Size()
+	return nil
+}
+
+//
+// rotate renames the file to "path.1", shifting older files along and
+// removing the oldest, then opens a new file.
+//
+func (r *rotatingFile) rotate() error {
+
+	r.file.Close()
+
+	for i := r.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+
+	var err error
+	if r.keep > 0 {
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.open()
+}
+
+//
+// Write appends to the file, rotating it first if it would otherwise
+// grow beyond its size.
+//
+func (r *rotatingFile) Write(p []byte) (int, error) {
+
+	if r.size > 0 && r.written > 0 && r.written+int64(len(p)) > r.size {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+//
+// newRequestID returns a random ID for a request.
+//
+func newRequestID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+//
+// requestID returns the ID of the request with the given context.
+//
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+//
+// requestIDs is a middleware which gives each request an ID, taken from
+// the X-Request-ID header if present, and returns it to the caller.
+//
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		id := req.Header.Get("X-Request-ID")
+		if len(id) == 0 || len(id) > 64 {
+			id = newRequestID()
+		}
+
+		res.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(req.Context(), requestIDContextKey{}, id)
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+//
+// decisionEntry returns the entry we log for the given verdict.
+//
+func decisionEntry(ctx context.Context, input Submission, v verdict, now time.Time) map[string]interface{} {
+
+	fields := make(map[string]string)
+	for name, value := range map[string]string{
+		"agent":   input.Agent,
+		"comment": input.Comment,
+		"email":   input.Email,
+		"link":    input.Link,
+		"name":    input.Name,
+		"subject": input.Subject,
+		"version": input.Version,
+	} {
+		if len(value) > 0 {
+			fields[name] = value
+		}
+	}
+
+	entry := map[string]interface{}{
+		"time":    now.UTC().Format(time.RFC3339Nano),
+		"site":    input.Site,
+		"ip":      input.IP,
+		"result":  "OK",
+		"time-ms": float64(v.Duration.Microseconds()) / 1000,
+		"fields":  fields,
+		"plugins": explainOutcomes(v.Outcomes),
+	}
+
+	if id := requestID(ctx); len(id) > 0 {
+		entry["request-id"] = id
+	}
+	if v.Spam {
+		entry["result"] = "SPAM"
+		entry["blocker"] = v.Blocker.Name
+		entry["reason"] = v.Reason
+	}
+	if score, ok := v.Extra["score"]; ok {
+		entry["score"] = score
+	}
+	if v.DryRun {
+		entry["dry-run"] = true
+	}
+	return entry
+}
+
+//
+// logDecision writes the given verdict to our decision log, if enabled.
+//
+func logDecision(ctx context.Context, input Submission, v verdict) {
+
+	if decisionLog == nil {
+		return
+	}
+
+	line, err := json.Marshal(decisionEntry(ctx, input, v, time.Now()))
+	if err != nil {
+		fmt.Printf("WARNING - Failed to encode decision - %s\n", err.Error())
+		return
+	}
+
+	decisionLogLock.Lock()
+	defer decisionLogLock.Unlock()
+
+	_, err = decisionLog.Write(append(line, '\n'))
+	if err != nil {
+		fmt.Printf("WARNING - Failed to log decision - %s\n", err.Error())
+	}
+}
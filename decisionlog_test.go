@@ -0,0 +1,174 @@
+//
+// Test for our decision log.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// withDecisionLog logs decisions to a buffer, for the duration of a
+// test.
+//
+func withDecisionLog(t *testing.T) *bytes.Buffer {
+
+	var buf bytes.Buffer
+
+	saved := decisionLog
+	decisionLog = &buf
+	t.Cleanup(func() { decisionLog = saved })
+
+	return &buf
+}
+
+//
+// Each decision is logged, with the ID of its request.
+//
+func TestDecisionLog(t *testing.T) {
+
+	buf := withDecisionLog(t)
+	router := newRouter()
+
+	bodies := []string{
+		`{"comment":"Moi Kissa","name":"http://example.com","site":"example.com","ip":"127.0.0.1"}`,
+		`{"comment":"Moi Kissa","name":"Steve","site":"example.com","ip":"127.0.0.1"}`,
+	}
+
+	for _, body := range bodies {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Request-ID", "test-id")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("Unexpected status-code: %v", rr.Code)
+		}
+		if id := rr.Header().Get("X-Request-ID"); id != "test-id" {
+			t.Errorf("Unexpected request ID: '%s'", id)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two decisions, got %d", len(lines))
+	}
+
+	results := []string{"SPAM", "OK"}
+	for i, line := range lines {
+
+		var entry struct {
+			RequestID string `json:"request-id"`
+			Site      string
+			IP        string
+			Result    string
+			Blocker   string
+			Fields    map[string]string
+			Plugins   []map[string]interface{}
+		}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("Failed to decode '%s': %s", line, err.Error())
+		}
+
+		if entry.RequestID != "test-id" || entry.Site != "example.com" || entry.IP != "127.0.0.1" {
+			t.Errorf("Unexpected entry: %s", line)
+		}
+		if entry.Result != results[i] {
+			t.Errorf("Unexpected result: %s", line)
+		}
+		if entry.Fields["comment"] != "Moi Kissa" {
+			t.Errorf("Missing comment: %s", line)
+		}
+		if len(entry.Plugins) == 0 {
+			t.Errorf("Missing plugins: %s", line)
+		}
+	}
+
+	if !strings.Contains(lines[0], `"blocker":"35-name.js"`) {
+		t.Errorf("Missing blocker: %s", lines[0])
+	}
+}
+
+//
+// Requests without an ID are given one.
+//
+func TestRequestID(t *testing.T) {
+
+	router := newRouter()
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "/plugins", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		id := rr.Header().Get("X-Request-ID")
+		if len(id) != 16 || ids[id] {
+			t.Errorf("Unexpected request ID: '%s'", id)
+		}
+		ids[id] = true
+	}
+}
+
+//
+// Log files are rotated once they reach their size.
+//
+func TestDecisionLogRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "decisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "decisions.log")
+
+	w, err := openDecisionLog(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err = w.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "four\nfive\n",
+		path + ".1": "three\n",
+		path + ".2": "one\ntwo\n",
+	}
+	for file, contents := range expected {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Errorf("Failed to read %s: %s", file, err.Error())
+		}
+		if string(data) != contents {
+			t.Errorf("Unexpected contents of %s: '%s'", file, data)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only two rotated files")
+	}
+}
@@ -0,0 +1,58 @@
+//
+//  Helpers for DNS-based blacklists.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//
+// normalizeIP parses the given address, returning nil if it is not
+// valid.
+//
+// IPv4-mapped IPv6 addresses, such as "::ffff:192.0.2.1", are returned
+// as plain IPv4 addresses.
+//
+func normalizeIP(ip string) net.IP {
+
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return nil
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4
+	}
+	return parsed
+}
+
+//
+// reverseIP returns the name we lookup beneath a DNSBL zone to test the
+// given address, or "" if it is not valid.
+//
+// IPv4 addresses have their octets reversed, so 192.0.2.1 becomes
+// "1.2.0.192".  IPv6 addresses have their nibbles reversed, so 2001:db8::1
+// becomes "1.0.0.0.[...].8.b.d.0.1.0.0.2".
+//
+func reverseIP(ip string) string {
+
+	parsed := normalizeIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if len(parsed) == net.IPv4len {
+		return fmt.Sprintf("%d.%d.%d.%d", parsed[3], parsed[2], parsed[1], parsed[0])
+	}
+
+	nibbles := make([]string, 0, 32)
+	for i := len(parsed) - 1; i >= 0; i-- {
+		nibbles = append(nibbles,
+			fmt.Sprintf("%x", parsed[i]&0x0f),
+			fmt.Sprintf("%x", parsed[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,31 @@
+//
+// Test for our DNSBL helpers.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+//
+// Test that addresses are reversed correctly.
+//
+func TestReverseIP(t *testing.T) {
+
+	inputs := map[string]string{
+		"192.0.2.1":               "1.2.0.192",
+		"::ffff:192.0.2.1":        "1.2.0.192",
+		"2001:db8::1":             "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+		"2001:DB8:0:0:0:0:0:ABCD": "d.c.b.a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+		"":                        "",
+		"not-an-ip":               "",
+		"1.2.3":                   "",
+	}
+
+	for input, expected := range inputs {
+		if output := reverseIP(input); output != expected {
+			t.Errorf("Unexpected result for '%s': %s", input, output)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//
+//  Explain the verdict for a submission.
+//
+//  If the options of a submission include "explain" then every plugin
+// is run, even after one has decided the submission is SPAM, and the
+// result, detail, and timing of each is returned to the caller.
+//
+//  Explanations are dry-runs: no counters are updated, and submitters
+// are never blacklisted.  Plugins which remember submissions, such as
+// those looking at velocity and duplicates, are told of dry-runs via
+// the context they're invoked with, so that they can count without
+// recording.
+//
+
+package main
+
+import (
+	"context"
+)
+
+//
+// The type of the context-key beneath which we flag dry-runs.
+//
+type dryRunContextKey struct{}
+
+//
+// withDryRun returns a context flagging a dry-run.
+//
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunContextKey{}, true)
+}
+
+//
+// isDryRun returns true if the given context is that of a dry-run, in
+// which case plugins must not record the submission.
+//
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunContextKey{}).(bool)
+	return dryRun
+}
+
+//
+// explainOutcomes converts the given plugin-outcomes into a form
+// suitable for returning to the caller.
+//
+func explainOutcomes(outcomes []pluginOutcome) []map[string]interface{} {
+
+	var ret []map[string]interface{}
+
+	for _, outcome := range outcomes {
+		ret = append(ret, map[string]interface{}{
+			"plugin":  outcome.Plugin.Name,
+			"result":  outcome.Result.String(),
+			"detail":  outcome.Detail,
+			"time-ms": float64(outcome.Duration.Microseconds()) / 1000,
+		})
+	}
+	return ret
+}
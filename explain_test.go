@@ -0,0 +1,85 @@
+//
+// Test for our explanations.
+//
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+//
+// Test that we spot requests for an explanation.
+//
+func TestExplainOption(t *testing.T) {
+
+	inputs := map[string]bool{
+		"":                        false,
+		"explain":                 true,
+		"explain=1":               true,
+		"explain=TRUE":            true,
+		"explain=no":              false,
+		"exclude=explain":         false,
+		"exclude=name,explain=1":  true,
+		"min-size=10,explain=yes": true,
+	}
+
+	for input, expected := range inputs {
+		if parseOptions(input).Explain != expected {
+			t.Errorf("Unexpected result for '%s'", input)
+		}
+	}
+}
+
+//
+// Test that explanations don't record the submission, so that asking
+// why a submission was blocked doesn't make the next one more likely
+// to be.
+//
+func TestExplainDryRun(t *testing.T) {
+
+	input := Submission{IP: "192.0.2.77", Site: "dry-run.example.com",
+		Comment: "An explained comment which is long enough to be fingerprinted by the duplicate plugin."}
+
+	counts := func() (int, int) {
+		velocityLock.Lock()
+		velocity := len(velocityTimes["ip-192.0.2.77"])
+		velocityLock.Unlock()
+
+		sum := duplicateSum(duplicateWords(input.Comment))
+		duplicates := 0
+		duplicateLock.Lock()
+		for _, entry := range duplicateEntries {
+			if entry.sum == sum {
+				duplicates++
+			}
+		}
+		duplicateLock.Unlock()
+		return velocity, duplicates
+	}
+
+	explained := input
+	explained.Options = parseOptions("explain")
+
+	for i := 0; i < 2; i++ {
+		_, err := testSubmission(context.Background(), explained)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if velocity, duplicates := counts(); velocity != 0 || duplicates != 0 {
+			t.Errorf("Explanation %d was recorded: velocity %d, duplicates %d", i, velocity, duplicates)
+		}
+	}
+
+	//
+	// Whereas a real submission is recorded.
+	//
+	_, err := testSubmission(context.Background(), input)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if velocity, duplicates := counts(); velocity != 1 || duplicates != 1 {
+		t.Errorf("Submission was not recorded: velocity %d, duplicates %d", velocity, duplicates)
+	}
+}
@@ -3,12 +3,16 @@
 //
 // * We receive a JSON POST which we'll convert into a simple structure.
 // * Then we run a bunch of "plugins" over the submission.
-// * If any single plugin decides the comment is spam, we drop it.
+// * By default the first plugin which decides the comment is spam
+//   drops it, but if the caller supplies a "score-threshold" option
+//   the weighted results of every plugin are totalled instead, see
+//   scoring.go.
 // * Otherwise we're all OK.
 //
 // We use redis to store per-site, and global, spam/ham counts, and
-// we write link/name/subject/email data to a logfile if it is ham
-// to see if we need to update our blacklist(s).
+// if the `-decision-log` flag is given we write each decision, with
+// the fields of the submission and the result of each plugin, to a
+// log, see decisionlog.go.
 //
 // This code is a bit ropy.
 //
@@ -19,16 +23,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -78,7 +83,10 @@ type Submission struct {
 	//
 	// Any options - optional
 	//
-	Options string
+	// These may be supplied as a comma-separated string, a JSON
+	// object, or a JSON array, see options.go.
+	//
+	Options Options
 
 	//
 	// The site this comment was for - mandatory
@@ -96,6 +104,21 @@ type Submission struct {
 	Version string
 }
 
+//
+// Classification is what we parse incoming re-training requests into.
+//
+// It is a normal submission, along with the class it should be
+// trained as.
+//
+type Classification struct {
+	Submission
+
+	//
+	// The class to train the submission as: "spam" or "ok" - mandatory
+	//
+	Train string
+}
+
 //
 // PluginResult is the return-code of each plugin-method.
 //
@@ -124,6 +147,23 @@ const (
 	Error
 )
 
+//
+// String converts a plugin-result into a human-readable name.
+//
+func (r PluginResult) String() string {
+	switch r {
+	case Spam:
+		return "Spam"
+	case Ham:
+		return "Ham"
+	case Undecided:
+		return "Undecided"
+	case Error:
+		return "Error"
+	}
+	return "Unknown"
+}
+
 //
 // PluginTest is the function which each plugin implements to check
 // an incoming Submission instance for SPAM.
@@ -134,6 +174,15 @@ const (
 //
 type PluginTest func(Submission) (PluginResult, string)
 
+//
+// PluginContextTest is the context-aware version of PluginTest.
+//
+// The context is cancelled when the client goes away, or when the
+// deadline for the request has passed, and plugins which make network
+// requests should honour it.
+//
+type PluginContextTest func(context.Context, Submission) (PluginResult, string)
+
 //
 // A BlogspamPlugin object is present for each plugin which is implemented,
 // and bundled with this repository.
@@ -161,6 +210,28 @@ type BlogspamPlugin struct {
 	//
 	Test PluginTest
 
+	//
+	// The context-aware function to invoke to use the plugin.
+	//
+	// If this is set it is used in preference to Test.
+	//
+	ContextTest PluginContextTest
+
+	//
+	// The weight given to this plugin's verdict when scoring.
+	//
+	// A zero weight is treated as 1.
+	//
+	Weight float64
+
+	//
+	// Does this plugin make network requests?
+	//
+	// Such plugins are run concurrently, after the local plugins,
+	// under a deadline.
+	//
+	Network bool
+
 	//
 	// Should SPAM-results be recorded in Redis?
 	//
@@ -168,6 +239,23 @@ type BlogspamPlugin struct {
 	// the results of expensive plugins.
 	//
 	RedisCache bool
+
+	//
+	// If set, only those SPAM-results whose detail this returns true
+	// for are recorded in Redis.
+	//
+	// The IP of the submitter is blacklisted for every site, so this
+	// allows a plugin to record only the results due to that IP.
+	//
+	Cacheable func(detail string) bool
+}
+
+//
+// caches returns true if a SPAM-result from this plugin, with the given
+// detail, should be recorded in Redis.
+//
+func (p BlogspamPlugin) caches(detail string) bool {
+	return p.RedisCache && (p.Cacheable == nil || p.Cacheable(detail))
 }
 
 //
@@ -191,6 +279,19 @@ var redisHandle *redis.Client
 //
 var verbose bool
 
+//
+// run invokes the plugin against the given submission.
+//
+// Plugins which only implement the older PluginTest signature are
+// adapted here, and cannot be interrupted.
+//
+func (p BlogspamPlugin) run(ctx context.Context, x Submission) (PluginResult, string) {
+	if p.ContextTest != nil {
+		return p.ContextTest(ctx, x)
+	}
+	return p.Test(x)
+}
+
 //
 // Register a plugin - we use this method to ensure that the plugins
 // are sorted by name, which means the lighter-weight plugins run
@@ -206,11 +307,73 @@ func registerPlugin(addition BlogspamPlugin) {
 }
 
 //
-// ClassifyHandler is a HTTP-Handler which should re-train the given input.
+// ClassifyHandler is a HTTP-Handler which re-trains the given input.
 //
-// However it is not implemented.
+// The submission is trained as either "spam" or "ok", according to
+// the value of the `train` field, which updates the token-counts used
+// by our bayesian plugin.
 //
 func ClassifyHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+			// Don't spam stdout when running test-cases.
+			if flag.Lookup("test.v") == nil {
+				fmt.Printf("WARNING - Error returned from /classify handler - %s\n", err.Error())
+			}
+		}
+	}()
+
+	//
+	// Ensure this was a POST-request
+	//
+	if req.Method != "POST" {
+		err = errors.New("Must be called via HTTP-POST")
+		status = http.StatusInternalServerError
+		return
+	}
+
+	//
+	// Decode the submitted JSON body
+	//
+	decoder := json.NewDecoder(req.Body)
+
+	//
+	// This is what we'll decode
+	//
+	var input Classification
+	err = decoder.Decode(&input)
+
+	//
+	// If decoding the JSON failed then we'll abort
+	//
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	//
+	// Ensure the caller may train submissions for this site.
+	//
+	err = checkAPIKeySite(req.Context(), input.Site)
+	if err != nil {
+		status = http.StatusForbidden
+		return
+	}
+
+	//
+	// Train the submission.
+	//
+	err = trainBayes(input.Submission, strings.ToLower(input.Train))
+	if err != nil {
+		status = http.StatusBadRequest
+		return
+	}
+
 	fmt.Fprintf(res, "OK")
 }
 
@@ -218,6 +381,9 @@ func ClassifyHandler(res http.ResponseWriter, req *http.Request) {
 // StatsHandler is a HTTP-handler which should return the per-site
 // statistics to the caller for the given site.
 //
+// If the caller supplies a `from`, `to`, or `granularity` then the
+// counts of each bucket within that range are included, see stats.go.
+//
 func StatsHandler(res http.ResponseWriter, req *http.Request) {
 	var (
 		status int
@@ -248,9 +414,15 @@ func StatsHandler(res http.ResponseWriter, req *http.Request) {
 	decoder := json.NewDecoder(req.Body)
 
 	//
-	// This is what we'll decode
+	// This is what we'll decode, the range and granularity are
+	// only present if the caller wants a series of buckets.
 	//
-	var input Submission
+	var input struct {
+		Site        string
+		From        string
+		To          string
+		Granularity string
+	}
 	err = decoder.Decode(&input)
 
 	//
@@ -261,6 +433,15 @@ func StatsHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	//
+	// Ensure the caller may fetch the statistics of this site.
+	//
+	err = checkAPIKeySite(req.Context(), input.Site)
+	if err != nil {
+		status = http.StatusForbidden
+		return
+	}
+
 	//
 	// Create a map for returning our results to the caller.
 	//
@@ -268,14 +449,14 @@ func StatsHandler(res http.ResponseWriter, req *http.Request) {
 	// we populate the return-value(s) in the event of an error,
 	// or if redis is disabled
 	//
-	ret := make(map[string]string)
+	ret := make(map[string]interface{})
 	ret["spam"] = "0"
 	ret["ok"] = "0"
 
 	//
 	// If we have a site then we're good
 	//
-	site := input.Site
+	site := siteKey(input.Site)
 
 	//
 	// Get the spam-count, and assuming no error then we
@@ -303,6 +484,25 @@ func StatsHandler(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	//
+	// Add the series of buckets, if the caller asked for them.
+	//
+	if len(input.From) > 0 || len(input.To) > 0 || len(input.Granularity) > 0 {
+		var q statsQuery
+		q, err = parseStatsQuery(input.From, input.To, input.Granularity, time.Now())
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+
+		ret["granularity"] = q.Granularity
+		ret["series"], err = statsSeries("site-"+site, q)
+		if err != nil {
+			status = http.StatusInternalServerError
+			return
+		}
+	}
+
 	//
 	// Convert this temporary hash to a JSON object we can return
 	//
@@ -322,6 +522,9 @@ func StatsHandler(res http.ResponseWriter, req *http.Request) {
 // GlobalStatsHandler is a HTTP-handler which should return the global
 // count of spam vs. ham.
 //
+// The range, and granularity, of buckets to include may be given as
+// query parameters.
+//
 func GlobalStatsHandler(res http.ResponseWriter, req *http.Request) {
 	var (
 		status int
@@ -344,7 +547,7 @@ func GlobalStatsHandler(res http.ResponseWriter, req *http.Request) {
 	// we populate the return-value(s) in the event of an error,
 	// or if redis is disabled
 	//
-	ret := make(map[string]string)
+	ret := make(map[string]interface{})
 	ret["spam"] = "0"
 	ret["ok"] = "0"
 
@@ -374,6 +577,33 @@ func GlobalStatsHandler(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	//
+	// Add the hits, and misses, of our cache.
+	//
+	for key, count := range cacheStats() {
+		ret[key] = strconv.FormatInt(count, 10)
+	}
+
+	//
+	// Add the series of buckets, if the caller asked for them.
+	//
+	query := req.URL.Query()
+	if len(query.Get("from")) > 0 || len(query.Get("to")) > 0 || len(query.Get("granularity")) > 0 {
+		var q statsQuery
+		q, err = parseStatsQuery(query.Get("from"), query.Get("to"), query.Get("granularity"), time.Now())
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+
+		ret["granularity"] = q.Granularity
+		ret["series"], err = statsSeries("global", q)
+		if err != nil {
+			status = http.StatusInternalServerError
+			return
+		}
+	}
+
 	//
 	// Convert this temporary hash to a JSON object we can return
 	//
@@ -391,59 +621,127 @@ func GlobalStatsHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 //
-// SendSpamResult informs the caller of a SPAM result.
+// A verdict is the outcome of testing a submission with our plugins.
 //
-// Bump our global and per-site count, if redis is available.
-//
-func SendSpamResult(res http.ResponseWriter, input Submission, plugin BlogspamPlugin, detail string) {
+type verdict struct {
+	//
+	// Was the submission SPAM?
+	//
+	Spam bool
 
-	if redisHandle != nil {
-		//
-		// Bump the global count of SPAM.
-		//
-		redisHandle.Incr("global-spam")
+	//
+	// The plugin which blocked the submission, if it was SPAM.
+	//
+	Blocker BlogspamPlugin
 
-		//
-		// Bump the per-site count of SPAM.
-		//
-		redisHandle.Incr(fmt.Sprintf("site-%s-spam", input.Site))
-	}
+	//
+	// The reason the submission was blocked.
+	//
+	Reason string
 
 	//
-	// This plugin-test resulted in a spam result, and we'll
-	// return that to the caller as JSON.
+	// If non-empty the submitter's IP should be blacklisted, in redis,
+	// with this detail.
+	//
+	Cache string
+
 	//
-	// Create a map to hold the details for now.
+	// Any extra values to return to the caller.
 	//
-	ret := make(map[string]string)
-	ret["result"] = "SPAM"
-	ret["blocker"] = plugin.Name
-	ret["reason"] = detail
-	ret["version"] = "2.0"
+	Extra map[string]interface{}
 
 	//
-	// Convert the temporary hash to a JSON-object.
+	// Is this verdict purely informational?
 	//
-	jsonString, err := json.Marshal(ret)
-	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	// If so it must not update any counters, or caches.
+	//
+	DryRun bool
 
 	//
-	// Send to the caller.
+	// The outcomes of the plugins which were run.
 	//
-	res.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(res, "%s", jsonString)
+	Outcomes []pluginOutcome
 
+	//
+	// How long testing the submission took.
+	//
+	Duration time.Duration
 }
 
 //
-// SendOKResult tells the caller their submission was not Spam.
+// response converts a verdict into the map we return to the caller.
 //
-// Bump our global and per-site count, if redis is available.
+func (v verdict) response() map[string]interface{} {
+
+	ret := make(map[string]interface{})
+	for key, val := range v.Extra {
+		ret[key] = val
+	}
+
+	if v.Spam {
+		ret["result"] = "SPAM"
+		ret["blocker"] = v.Blocker.Name
+		ret["reason"] = v.Reason
+		ret["version"] = "2.0"
+	} else {
+		ret["result"] = "OK"
+		ret["version"] = "3.0"
+	}
+	return ret
+}
+
+//
+// recordVerdict updates our records of the given verdict.
+//
+// Bump our global and per-site count, if redis is available, and
+// blacklist the submitter if we should.  Every verdict is written to
+// the decision log, if enabled.
 //
-func SendOKResult(res http.ResponseWriter, input Submission) {
+// Dry-runs are logged, but never counted.
+//
+func recordVerdict(ctx context.Context, input Submission, v verdict) {
+
+	logDecision(ctx, input, v)
+
+	if v.DryRun {
+		return
+	}
+
+	label := metricSite(ctx, input.Site)
+	observeVerdict(label, v)
+
+	//
+	// Without redis we only keep the series of the sites we know,
+	// since they're held in memory for a long time.
+	//
+	scope := siteKey(input.Site)
+	if redisHandle == nil && label == "other" {
+		scope = ""
+	}
+	recordStats(scope, v, time.Now())
+
+	if v.Spam {
+		if redisHandle != nil {
+			//
+			// Bump the global count of SPAM.
+			//
+			redisHandle.Incr("global-spam")
+
+			//
+			// Bump the per-site count of SPAM.
+			//
+			redisHandle.Incr(fmt.Sprintf("site-%s-spam", siteKey(input.Site)))
+		}
+
+		//
+		// If we should cache in redis, and redis
+		// is enabled, do so
+		//
+		if len(v.Cache) > 0 {
+			cacheBlacklisted(input, v.Cache)
+		}
+		return
+	}
 
 	if redisHandle != nil {
 		//
@@ -454,27 +752,154 @@ func SendOKResult(res http.ResponseWriter, input Submission) {
 		//
 		// Bump the per-site Ham-count
 		//
-		redisHandle.Incr(fmt.Sprintf("site-%s-ok", input.Site))
+		redisHandle.Incr(fmt.Sprintf("site-%s-ok", siteKey(input.Site)))
 	}
+}
+
+//
+// testSubmission invokes our plugins against the given submission and
+// returns the verdict.
+//
+// No counters are updated, see recordVerdict for that.
+//
+func testSubmission(ctx context.Context, input Submission) (verdict, error) {
+
+	start := time.Now()
+
+	//
+	// Merge the options with the policy of the site.
+	//
+	input.Options = applyPolicy(input)
+
+	//
+	// We might have options which will disable upcoming plugins.
+	//
+	exclude := input.Options.Exclude
 
 	//
-	// Log some fields in case of error.
+	// If the caller specified a score-threshold then we weigh the
+	// results of every plugin, rather than stopping at the first
+	// plugin to reach a verdict.
 	//
-	if len(input.Link) > 0 {
-		log.Printf("Link: %s\n", input.Link)
+	threshold, scoring, err := scoreThreshold(input.Options)
+	if err != nil {
+		return verdict{}, err
 	}
-	if len(input.Name) > 0 {
-		log.Printf("Name: %s\n", input.Name)
+
+	//
+	// If the caller wants an explanation we also run every plugin.
+	//
+	explain := input.Options.Explain
+	if explain {
+		ctx = withDryRun(ctx)
+	}
+
+	//
+	// Now we invoke each known-plugin, unless we're to exclude
+	// any specific one.
+	//
+	outcomes := runPlugins(ctx, input, exclude, !scoring && !explain)
+
+	var ret verdict
+	if scoring {
+		ret = scoreOutcomes(outcomes, threshold)
+	} else {
+		ret = decideOutcomes(outcomes)
 	}
-	if len(input.Subject) > 0 {
-		log.Printf("Subject: %s\n", input.Subject)
+	ret.Outcomes = outcomes
+
+	if explain {
+		ret.DryRun = true
+		if ret.Extra == nil {
+			ret.Extra = make(map[string]interface{})
+		}
+		ret.Extra["plugins"] = explainOutcomes(outcomes)
 	}
 
 	//
-	// Send the result to the caller.
+	// Let the caller know about any options we didn't recognise.
 	//
-	res.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(res, "{\"result\":\"OK\", \"version\":\"3.0\"}")
+	if len(input.Options.Unknown) > 0 {
+		if ret.Extra == nil {
+			ret.Extra = make(map[string]interface{})
+		}
+		ret.Extra["unknown-options"] = input.Options.Unknown
+	}
+
+	ret.Duration = time.Since(start)
+	return ret, nil
+}
+
+//
+// decideOutcomes returns the verdict of the first plugin to have
+// decided the submission was either SPAM or HAM.
+//
+func decideOutcomes(outcomes []pluginOutcome) verdict {
+
+	for _, outcome := range outcomes {
+
+		if outcome.Result == Spam {
+			//
+			// If the plugin-method decided this submission was
+			// SPAM then that is our verdict.
+			//
+			ret := verdict{Spam: true,
+				Blocker: outcome.Plugin,
+				Reason:  outcome.Detail}
+
+			if outcome.Plugin.caches(outcome.Detail) {
+				ret.Cache = outcome.Detail
+			}
+			return ret
+		}
+		if outcome.Result == Ham {
+
+			//
+			// The result is definitely OK.
+			//
+			return verdict{}
+		}
+	}
+
+	//
+	// If we reached this point no plugin decided this was SPAM,
+	// so we default to saying it was Ham.
+	//
+	return verdict{}
+}
+
+//
+// dumpSubmission shows the non-empty fields of the given submission
+// on STDOUT.
+//
+func dumpSubmission(input Submission) {
+
+	//
+	// Get all the fields of the structure, via reflection
+	//
+	s := reflect.ValueOf(&input).Elem()
+	typeOfT := s.Type()
+
+	//
+	// Iterate over the fields.
+	//
+	for i := 0; i < s.NumField(); i++ {
+
+		// The specific field
+		f := s.Field(i)
+
+		// The name/value of the field
+		fieldName := typeOfT.Field(i).Name
+		fieldVal := fmt.Sprintf("%s", f.Interface())
+		if f.Kind() != reflect.String {
+			fieldVal = fmt.Sprintf("%+v", f.Interface())
+		}
+
+		// Print non-empty fields
+		if len(fieldVal) > 0 {
+			fmt.Printf("\t%s : %s\n", fieldName, fieldVal)
+		}
+	}
 }
 
 //
@@ -530,175 +955,82 @@ func SpamTestHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	//
+	// Ensure the caller may submit comments for this site.
+	//
+	err = checkAPIKeySite(req.Context(), input.Site)
+	if err != nil {
+		status = http.StatusForbidden
+		return
+	}
+
 	//
 	// Dump the incoming request to STDOUT if running verbosely.
 	//
 	if verbose {
-
-		//
-		// Get all the fields of the structure, via reflection
-		//
-		s := reflect.ValueOf(&input).Elem()
-		typeOfT := s.Type()
-
-		//
-		// Iterate over the fields.
-		//
-		for i := 0; i < s.NumField(); i++ {
-
-			// The specific field
-			f := s.Field(i)
-
-			// The name/value of the field
-			fieldName := typeOfT.Field(i).Name
-			fieldVal := fmt.Sprintf("%s", f.Interface())
-
-			// Print non-empty fields
-			if len(fieldVal) > 0 {
-				fmt.Printf("\t%s : %s\n", fieldName, fieldVal)
-			}
-		}
+		dumpSubmission(input)
 	}
 
 	//
-	// We might have options which will disable upcoming plugins.
-	//
-	// If so we'll keep track of the plugins that are excluded here.
+	// Test the submission.
 	//
-	var exclude []string
+	result, err := testSubmission(req.Context(), input)
+	if err != nil {
+		status = http.StatusBadRequest
+		return
+	}
 
 	//
-	// Do we have options?
+	// Record the result.
 	//
-	if len(input.Options) > 0 {
-
-		//
-		// Split the string into an array, based on commas
-		//
-		options := strings.Split(input.Options, ",")
+	recordVerdict(req.Context(), input, result)
 
-		//
-		// Now look for exclusions
-		//
-		for _, option := range options {
-			re := regexp.MustCompile("^exclude=(.*)$")
-			match := re.FindStringSubmatch(option)
-
-			if len(match) > 0 {
-				exclude = append(exclude, match[1])
-			}
-		}
+	//
+	// Convert the result to a JSON-object.
+	//
+	jsonString, err := json.Marshal(result.response())
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
 	}
 
 	//
-	// Now we invoke each known-plugin, unless we're to exclude
-	// any specific one.
+	// Send to the caller.
 	//
-	for _, obj := range plugins {
-
-		//
-		// The name of this plugin, and whether we should skip it
-		//
-		name := obj.Name
-		var skip = false
-
-		//
-		// Look for exclusion(s)
-		//
-		for _, ex := range exclude {
-
-			//
-			// Look for this plugin being excluded.
-			//
-			if strings.Contains(name, ex) || name == ex {
-				skip = true
-			}
-		}
-
-		if skip {
-			continue
-		}
-
-		//
-		// Call the plugin method to run the test.
-		//
-		result, detail := obj.Test(input)
-
-		//
-		// Show the result of each plugin, if running verbosely
-		//
-		if verbose {
-
-			//
-			// Rather than showing the enum the plugin returns
-			// we decode it into the human-readable version.
-			//
-			human := ""
-			switch result {
-			case Spam:
-				human = "Spam"
-			case Undecided:
-				human = "Undecided"
-			case Error:
-				human = "Error"
-			case Ham:
-				human = "Ham"
-			}
-
-			// Show the output
-			fmt.Printf("Plugin %s returned: %s %s\n",
-				obj.Name, human, detail)
-		}
-
-		if result == Spam {
-			//
-			// If the plugin-method decided this submission was
-			// SPAM then we immediately return that result to the
-			// caller of our service.
-			//
-			SendSpamResult(res, input, obj, detail)
-
-			//
-			// If we should cache in redis, and redis
-			// is enabled, do so
-			//
-			if (obj.RedisCache == true) && (redisHandle != nil) {
-				key := fmt.Sprintf("blacklist-%s", input.IP)
-				period := time.Hour * 48
-				err := redisHandle.Set(key, detail, period).Err()
-				if err != nil {
-					fmt.Printf("WARNING redis-error blacklisting IP %s - %s\n", input.IP, err.Error())
-				}
-			}
-
-			return
-		}
-		if result == Ham {
-
-			//
-			// The result is definitely OK - tell the caller.
-			//
-			SendOKResult(res, input)
-			return
-
-		}
-		if result == Undecided {
+	res.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(res, "%s", jsonString)
+}
 
-			// Nop
+//
+// isExcluded returns true if the named plugin is matched by any of
+// the given exclusions.
+//
+func isExcluded(name string, exclude []string) bool {
+	for _, ex := range exclude {
+		if strings.Contains(name, ex) || name == ex {
+			return true
 		}
-		if result == Error {
+	}
+	return false
+}
 
-			// Nop
-			fmt.Printf("Error running plugin: %s\n\t%s\n",
-				obj.Name, detail)
-		}
+//
+// cacheBlacklisted records the IP of the given submission as being
+// blacklisted, if redis is enabled.
+//
+// This is used to cache the results of expensive plugins.
+//
+func cacheBlacklisted(input Submission, detail string) {
+	if redisHandle == nil {
+		return
 	}
 
-	//
-	// If we reached this point no plugin decided this was SPAM,
-	// so we default to saying it was Ham.
-	//
-	SendOKResult(res, input)
+	key := fmt.Sprintf("blacklist-%s", input.IP)
+	period := time.Hour * 48
+	err := redisHandle.Set(key, detail, period).Err()
+	if err != nil {
+		fmt.Printf("WARNING redis-error blacklisting IP %s - %s\n", input.IP, err.Error())
+	}
 }
 
 //
@@ -752,13 +1084,10 @@ func PluginListHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 //
-// Launch our HTTP server
+// Create a new router and our route-mappings.
 //
-func serve(host string, port int) {
+func newRouter() *mux.Router {
 
-	//
-	// Create a new router and our route-mappings.
-	//
 	router := mux.NewRouter()
 
 	//
@@ -778,7 +1107,7 @@ func serve(host string, port int) {
 	router.HandleFunc("/stats", StatsHandler).Methods("POST")
 	router.HandleFunc("/stats/", StatsHandler).Methods("POST")
 	//
-	//  4.  Classify/Train comments (nop).
+	//  4.  Classify/Train comments.
 	//
 	router.HandleFunc("/classify", ClassifyHandler).Methods("POST")
 	router.HandleFunc("/classify/", ClassifyHandler).Methods("POST")
@@ -787,6 +1116,51 @@ func serve(host string, port int) {
 	//
 	router.HandleFunc("/global-stats", GlobalStatsHandler).Methods("GET")
 	router.HandleFunc("/global-stats/", GlobalStatsHandler).Methods("GET")
+	//
+	//  6. Batch spam-test
+	//
+	router.HandleFunc("/batch", BatchHandler).Methods("POST")
+	router.HandleFunc("/batch/", BatchHandler).Methods("POST")
+	//
+	//  7. Metrics, for Prometheus.
+	//
+	router.HandleFunc("/metrics", MetricsHandler).Methods("GET")
+	//
+	//  8. Administration, which requires a token.
+	//
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuth)
+	admin.HandleFunc("/blacklist/{field}", AdminBlacklistHandler).Methods("GET", "POST", "DELETE")
+	//
+	//  9. Per-site policies, which also require a token.
+	//
+	sites := router.PathPrefix("/sites").Subrouter()
+	sites.Use(adminAuth)
+	sites.HandleFunc("/{site}/policy", SitePolicyHandler).Methods("GET", "PUT")
+	sites.HandleFunc("/{site}/keys", SiteKeyHandler).Methods("POST")
+
+	//
+	// Every request is given an ID, and counted, clients are
+	// rate-limited, if enabled, and API keys are checked for all
+	// end-points, if required.
+	//
+	router.Use(requestIDs)
+	router.Use(countRequests)
+	router.Use(rateLimiter)
+	router.Use(apiKeyAuth)
+
+	return router
+}
+
+//
+// Launch our HTTP server
+//
+func serve(host string, port int) {
+
+	//
+	// Create a new router and our route-mappings.
+	//
+	router := newRouter()
 
 	//
 	// Bind the router.
@@ -815,6 +1189,13 @@ func serve(host string, port int) {
 
 func main() {
 
+	//
+	// Importing the StopForumSpam lists is a subcommand of its own.
+	//
+	if len(os.Args) > 1 && os.Args[1] == "import-sfs" {
+		os.Exit(importSFSMain(os.Args[2:]))
+	}
+
 	//
 	// The command-line flags we support
 	//
@@ -826,6 +1207,128 @@ func main() {
 	port := flag.Int("port", 9999, "The port number to listen upon")
 	verb := flag.Bool("verbose", false, "Should we be verbose")
 
+	//
+	// The probability above which our bayesian plugin reports SPAM.
+	//
+	flag.Float64Var(&bayesThreshold, "bayes-threshold", bayesThreshold,
+		"The spam-probability at which trained comments are rejected.")
+
+	//
+	// The deadline for network-plugins, per-request.
+	//
+	flag.DurationVar(&networkTimeout, "network-timeout", networkTimeout,
+		"The maximum time to wait for network-based plugins.")
+
+	//
+	// The number of submissions in a batch to test concurrently.
+	//
+	flag.IntVar(&batchWorkers, "batch-workers", batchWorkers,
+		"The number of batch-submissions to test concurrently.")
+
+	//
+	// The token which enables the admin API.
+	//
+	flag.StringVar(&adminToken, "admin-token", "",
+		"The token required to use the admin API, which is disabled if empty.")
+
+	//
+	// How often to reload the blacklisted patterns stored in redis.
+	//
+	flag.DurationVar(&blacklistRefresh, "blacklist-refresh", blacklistRefresh,
+		"How often to reload the blacklisted patterns stored in redis, zero to disable.")
+
+	//
+	// The file storing per-site policies, if redis is not used.
+	//
+	flag.StringVar(&policyFile, "policy-file", policyFile,
+		"The file to store per-site policies within, if redis is not used.")
+
+	//
+	// Submission velocity.
+	//
+	flag.DurationVar(&velocityWindow, "velocity-window", velocityWindow,
+		"The window over which to count submissions from each IP and network.")
+	flag.IntVar(&velocityIPLimit, "velocity-ip", velocityIPLimit,
+		"The number of submissions permitted from an IP within the window, zero to disable.")
+	flag.IntVar(&velocityNetworkLimit, "velocity-network", velocityNetworkLimit,
+		"The number of submissions permitted from a /24, or /64, within the window, zero to disable.")
+
+	//
+	// Duplicate comments.
+	//
+	flag.DurationVar(&duplicateWindow, "duplicate-window", duplicateWindow,
+		"The window within which to look for duplicate comments.")
+	flag.IntVar(&duplicateSites, "duplicate-sites", duplicateSites,
+		"The number of sites a comment may be posted to within the window, zero to disable.")
+
+	//
+	// Rate-limiting of the API.
+	//
+	flag.Float64Var(&rateLimit, "rate-limit", rateLimit,
+		"The number of requests per second each client may make, zero to disable.")
+	flag.IntVar(&rateBurst, "rate-burst", rateBurst,
+		"The number of requests each client may burst above the rate-limit.")
+
+	//
+	// API keys.
+	//
+	flag.BoolVar(&apiKeysRequired, "require-api-key", false,
+		"Require per-site API keys for submissions, training, and statistics.")
+	flag.StringVar(&apiKeyFile, "api-key-file", apiKeyFile,
+		"The file to store API keys within, if redis is not used.")
+
+	//
+	// The DNS resolver our plugins use.
+	//
+	rsolver := flag.String("resolver", "",
+		"The host:port of the DNS server to use, rather than the system resolver.")
+	rtimeout := flag.Duration("resolver-timeout", 2*time.Second,
+		"The timeout for each query made to the -resolver.")
+	rretries := flag.Int("resolver-retries", 2,
+		"The number of times to retry failed queries made to the -resolver.")
+
+	//
+	// StopForumSpam.
+	//
+	flag.StringVar(&sfsURL, "sfs-url", sfsURL,
+		"The StopForumSpam API end-point.")
+	flag.IntVar(&sfsFrequency, "sfs-frequency", sfsFrequency,
+		"The number of times a submitter must have been reported to StopForumSpam.")
+	flag.Float64Var(&sfsConfidence, "sfs-confidence", sfsConfidence,
+		"The confidence, as a percentage, StopForumSpam must have in a report.")
+	flag.DurationVar(&sfsMaxAge, "sfs-max-age", sfsMaxAge,
+		"How recently a submitter must have been reported to StopForumSpam, zero for any time.")
+	slists := flag.String("sfs-lists", "",
+		"The StopForumSpam lists to load, as a comma-separated list of files or URLs.")
+	flag.DurationVar(&sfsListRefresh, "sfs-lists-refresh", sfsListRefresh,
+		"How often to reload the -sfs-lists, zero to load them once.")
+
+	//
+	// The cache of network lookups.
+	//
+	cttl := flag.String("cache-ttl", "",
+		"The time to cache lookups for, by source, e.g. \"dnsbl=1h,mx=6h,sfs=1h\".")
+	flag.IntVar(&cacheSize, "cache-size", cacheSize,
+		"The number of lookups to cache in memory, if redis is not used.")
+
+	//
+	// The log of our decisions.
+	//
+	dlog := flag.String("decision-log", "",
+		"Log each decision to this file, \"-\" for STDOUT, or \"syslog\".")
+	dsize := flag.Int64("decision-log-size", 100,
+		"The size, in megabytes, at which the -decision-log file is rotated, zero to disable.")
+	dkeep := flag.Int("decision-log-keep", 5,
+		"The number of rotated -decision-log files to keep.")
+
+	//
+	// The retention of our time-series statistics.
+	//
+	flag.DurationVar(&statsHourlyRetention, "stats-hourly-retention", statsHourlyRetention,
+		"How long to keep hourly statistics.")
+	flag.DurationVar(&statsDailyRetention, "stats-daily-retention", statsDailyRetention,
+		"How long to keep daily statistics.")
+
 	//
 	// Optional redis-server address
 	//
@@ -842,6 +1345,27 @@ func main() {
 	//
 	verbose = (*verb == true)
 
+	//
+	// Update the TTLs of our cache.
+	//
+	err := parseCacheTTLs(*cttl)
+	if err != nil {
+		fmt.Printf("Invalid -cache-ttl - %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	//
+	// If a resolver was specified then use it.
+	//
+	if len(*rsolver) > 0 {
+		server := *rsolver
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		fmt.Printf("Using DNS resolver %s\n", server)
+		resolver = newResolver(server, *rtimeout, *rretries)
+	}
+
 	//
 	// If redis host/port was specified then open the connection now.
 	//
@@ -852,25 +1376,52 @@ func main() {
 			Password: "", // no password set
 			DB:       0,  // use default DB
 		})
+		instrumentRedis(redisHandle)
 	} else {
 		redisHandle = nil
 	}
 
 	//
-	// Open our logfile for ham
+	// Open the log of our decisions, if any.
+	//
+	decisionLog, err = openDecisionLog(*dlog, *dsize*1024*1024, *dkeep)
+	if err != nil {
+		fmt.Printf("Failed to open decision log - %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	//
+	// Load our blacklists, and reload them when they change.
+	//
+	reportBlacklists()
+	watchBlacklists()
+
+	//
+	// Load any per-site policies.
+	//
+	err = loadPolicies()
+	if err != nil {
+		fmt.Printf("WARNING - Failed to load policies - %s\n", err.Error())
+	}
+
+	//
+	// Load any API keys.
 	//
-	hamLog, err := os.OpenFile("/tmp/ham.log",
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	err = loadAPIKeys()
 	if err != nil {
-		fmt.Printf("Error opening file: %v", err)
+		fmt.Printf("Failed to load API keys - %s\n", err.Error())
 		os.Exit(1)
 	}
-	defer hamLog.Close()
 
 	//
-	// Set the log-target.
+	// Load the StopForumSpam lists, if any, and keep them fresh.
 	//
-	log.SetOutput(hamLog)
+	for _, source := range strings.Split(*slists, ",") {
+		if source = strings.TrimSpace(source); len(source) > 0 {
+			sfsListSources = append(sfsListSources, source)
+		}
+	}
+	refreshSFSLists()
 
 	//
 	// And finally start our server
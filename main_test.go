@@ -163,3 +163,137 @@ func TestPluginList(t *testing.T) {
 	}
 
 }
+
+//
+// Test that we can train a comment, and that bogus classes are rejected.
+//
+func TestClassify(t *testing.T) {
+	defer resetBayes()
+
+	inputs := map[string]int{
+		"{\"comment\":\"Moi Kissa\",\"train\":\"spam\"}":  http.StatusOK,
+		"{\"comment\":\"Moi Kissa\",\"train\":\"OK\"}":    http.StatusOK,
+		"{\"comment\":\"Moi Kissa\",\"train\":\"maybe\"}": http.StatusBadRequest,
+	}
+
+	for input, expected := range inputs {
+
+		req, err := http.NewRequest("POST", "/classify", bytes.NewReader([]byte(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ClassifyHandler)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code for %s: %v", input, status)
+		}
+	}
+
+	if bayesCounts.totals["spam"] != 1 || bayesCounts.totals["ok"] != 1 {
+		t.Errorf("Unexpected training totals: %v", bayesCounts.totals)
+	}
+}
+
+//
+// The name-check plugin will mark a submission as spam, but in scoring
+// mode that only counts if the threshold is low enough.
+//
+func TestSpamScoring(t *testing.T) {
+
+	inputs := map[string]string{
+		"score-threshold=1": "SPAM",
+		"score-threshold=2": "OK",
+	}
+
+	for options, expected := range inputs {
+		body := []byte("{\"options\":\"" + options + ",exclude=80-sfs\",\"comment\":\"Moi Kissa\",\"name\":\"http://example.com\", \"site\":\"example.com\", \"ip\": \"127.0.0.1\"}")
+
+		req, err := http.NewRequest("POST", "/", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(SpamTestHandler)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("Unexpected status-code: %v", status)
+		}
+
+		if !strings.Contains(rr.Body.String(), "\"result\":\""+expected+"\"") {
+			t.Errorf("Body was '%v' not %s", rr.Body.String(), expected)
+		}
+		if !strings.Contains(rr.Body.String(), "\"35-name.js\":1") {
+			t.Errorf("Body was '%v' without scores", rr.Body.String())
+		}
+	}
+}
+
+//
+// Explanations include the results of plugins after the first to
+// decide the submission is SPAM.
+//
+func TestSpamExplain(t *testing.T) {
+	body := []byte("{\"options\":\"explain,exclude=80-sfs\",\"comment\":\"Moi Kissa\",\"name\":\"http://example.com\", \"site\":\"example.com\", \"ip\": \"127.0.0.1\"}")
+
+	req, err := http.NewRequest("POST", "/", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(SpamTestHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	expected := []string{"\"result\":\"SPAM\"",
+		"\"blocker\":\"35-name.js\"",
+		"\"plugin\":\"50-multilinks.js\"",
+		"\"time-ms\":"}
+
+	for _, str := range expected {
+		if !strings.Contains(rr.Body.String(), str) {
+			t.Errorf("Body was '%v' without %s", rr.Body.String(), str)
+		}
+	}
+	if strings.Contains(rr.Body.String(), "80-sfs.js") {
+		t.Errorf("Body was '%v' including excluded plugin", rr.Body.String())
+	}
+}
+
+//
+// Options may be supplied as a JSON object, and any keys we don't
+// recognise are reported.
+//
+func TestSpamOptionsObject(t *testing.T) {
+	body := []byte("{\"options\":{\"exclude\":[\"80-sfs\",\"35-name\"],\"colour\":\"red\"},\"comment\":\"Moi Kissa\",\"name\":\"http://example.com\", \"site\":\"example.com\", \"ip\": \"127.0.0.1\"}")
+
+	req, err := http.NewRequest("POST", "/", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(SpamTestHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	expected := []string{"\"result\":\"OK\"",
+		"\"unknown-options\":[\"colour\"]"}
+
+	for _, str := range expected {
+		if !strings.Contains(rr.Body.String(), str) {
+			t.Errorf("Body was '%v' without %s", rr.Body.String(), str)
+		}
+	}
+}
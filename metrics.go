@@ -0,0 +1,404 @@
+//
+//  Metrics, in the Prometheus text format.
+//
+//  The /metrics end-point exposes:
+//
+//    blogspam_requests_total            Requests, by end-point and status.
+//    blogspam_verdicts_total            Verdicts, by site, result, and the
+//                                       plugin which blocked them.  Sites
+//                                       without an API key, or a policy,
+//                                       are counted as "other".
+//    blogspam_plugin_duration_seconds   A histogram of the time taken by
+//                                       each plugin.
+//    blogspam_plugin_errors_total       The Error results of each plugin.
+//    blogspam_redis_errors_total        Failed redis commands.
+//
+//  The format is simple enough that we write it ourselves, rather than
+// pulling in the Prometheus client library.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+)
+
+//
+// metric is something which can write itself in the text format.
+//
+type metric interface {
+	write(w io.Writer)
+}
+
+//
+// counterVec is a set of counters, distinguished by their labels.
+//
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+//
+// histogramVec is a set of histograms, distinguished by their labels.
+//
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogram
+}
+
+//
+// histogram holds the observations of a single histogram.
+//
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+//
+// The metrics we expose.
+//
+var (
+	requestsTotal = newCounterVec("blogspam_requests_total",
+		"HTTP requests, by end-point and status.",
+		"endpoint", "status")
+
+	verdictsTotal = newCounterVec("blogspam_verdicts_total",
+		"Verdicts, by site, result, and the plugin which blocked the submission.",
+		"site", "result", "blocker")
+
+	pluginDuration = newHistogramVec("blogspam_plugin_duration_seconds",
+		"The time taken by each plugin.",
+		[]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		"plugin")
+
+	pluginErrors = newCounterVec("blogspam_plugin_errors_total",
+		"Error results returned by each plugin.",
+		"plugin")
+
+	redisErrors = newCounterVec("blogspam_redis_errors_total",
+		"Failed redis commands.",
+		"command")
+
+	allMetrics = []metric{requestsTotal, verdictsTotal, pluginDuration, pluginErrors, redisErrors}
+)
+
+//
+// newCounterVec creates a set of counters with the given labels.
+//
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels,
+		values: make(map[string]float64)}
+}
+
+//
+// newHistogramVec creates a set of histograms, with the given upper
+// bounds, and labels.
+//
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets,
+		series: make(map[string]*histogram)}
+}
+
+//
+// labelKey returns the given label values, escaped and joined, for use
+// as a map key and within our output.
+//
+func labelKey(names []string, values []string) string {
+
+	var pairs []string
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+//
+// formatFloat formats a value as Prometheus expects.
+//
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+//
+// inc increments the counter with the given label values.
+//
+func (c *counterVec) inc(values ...string) {
+	key := labelKey(c.labels, values)
+
+	c.lock.Lock()
+	c.values[key]++
+	c.lock.Unlock()
+}
+
+//
+// get returns the counter with the given label values.
+//
+func (c *counterVec) get(values ...string) float64 {
+	key := labelKey(c.labels, values)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+//
+// write writes our counters, sorted by their labels.
+//
+func (c *counterVec) write(w io.Writer) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+
+	var keys []string
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+//
+// observe records the given value in the histogram with the given
+// label values.
+//
+func (h *histogramVec) observe(value float64, values ...string) {
+	key := labelKey(h.labels, values)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+//
+// write writes our histograms, sorted by their labels.
+//
+func (h *histogramVec) write(w io.Writer) {
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	var keys []string
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, key, formatFloat(bound), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, key, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, key, s.count)
+	}
+}
+
+//
+// observePlugins records the time taken by each of the given outcomes,
+// and any errors.
+//
+func observePlugins(outcomes []pluginOutcome) {
+	for _, outcome := range outcomes {
+		pluginDuration.observe(outcome.Duration.Seconds(), outcome.Plugin.Name)
+		if outcome.Result == Error {
+			pluginErrors.inc(outcome.Plugin.Name)
+		}
+	}
+}
+
+//
+// metricSite returns the label we count verdicts for the given site
+// beneath.
+//
+// Anybody may submit comments naming any site, so to keep the number of
+// labels bounded only sites which were submitted with their API key, or
+// which have a policy, are labelled with their siteKey.  The rest share
+// the label "other".
+//
+func metricSite(ctx context.Context, site string) string {
+
+	key := siteKey(site)
+
+	if allowed, ok := ctx.Value(apiSiteContextKey{}).(string); ok && allowed == key {
+		return key
+	}
+	if policy, err := sitePolicy(site); err == nil && policy != nil {
+		return key
+	}
+	return "other"
+}
+
+//
+// observeVerdict records the given verdict beneath the given label, as
+// returned by metricSite.
+//
+func observeVerdict(site string, v verdict) {
+	if v.Spam {
+		verdictsTotal.inc(site, "SPAM", v.Blocker.Name)
+	} else {
+		verdictsTotal.inc(site, "OK", "")
+	}
+}
+
+//
+// instrumentRedis counts the failed commands of the given client.
+//
+// A missing key is not a failure.
+//
+func instrumentRedis(client *redis.Client) {
+
+	failed := func(cmd redis.Cmder) {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			redisErrors.inc(cmd.Name())
+		}
+	}
+
+	client.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			err := old(cmd)
+			failed(cmd)
+			return err
+		}
+	})
+	client.WrapProcessPipeline(func(old func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			err := old(cmds)
+			for _, cmd := range cmds {
+				failed(cmd)
+			}
+			return err
+		}
+	})
+}
+
+//
+// statusRecorder records the status of the response written through
+// it.
+//
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+//
+// WriteHeader records the status.
+//
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+//
+// Write records an implicit status of 200 OK.
+//
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+//
+// Flush flushes the response, if supported, for our batch end-point.
+//
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//
+// Unwrap returns the wrapped response, so that a http.ResponseController
+// may find the features it supports, such as full-duplex for our batch
+// end-point.
+//
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+//
+// countRequests is a middleware which counts requests by the template
+// of the route they matched, and the status of their response.
+//
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		endpoint := req.URL.Path
+		if route := mux.CurrentRoute(req); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				endpoint = template
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: res}
+		next.ServeHTTP(recorder, req)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		requestsTotal.inc(endpoint, strconv.Itoa(recorder.status))
+	})
+}
+
+//
+// MetricsHandler is a HTTP-Handler which returns our metrics in the
+// Prometheus text format.
+//
+func MetricsHandler(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, m := range allMetrics {
+		m.write(res)
+	}
+}
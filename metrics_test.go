@@ -0,0 +1,169 @@
+//
+// Test for our metrics.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//
+// Requests, verdicts, and plugin timings are exposed.
+//
+func TestMetrics(t *testing.T) {
+
+	router := newRouter()
+
+	body := []byte(`{"comment":"Moi Kissa","name":"http://example.com","site":"metrics.example.com","ip":"127.0.0.1"}`)
+	req, err := http.NewRequest("POST", "/", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("GET", "/sites/example.com/policy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	expected := []string{
+		`# TYPE blogspam_requests_total counter`,
+		`blogspam_requests_total{endpoint="/",status="200"}`,
+		`blogspam_requests_total{endpoint="/sites/{site}/policy",status="403"}`,
+		`blogspam_verdicts_total{site="other",result="SPAM",blocker="35-name.js"}`,
+		`# TYPE blogspam_plugin_duration_seconds histogram`,
+		`blogspam_plugin_duration_seconds_bucket{plugin="35-name.js",le="+Inf"}`,
+		`blogspam_plugin_duration_seconds_count{plugin="35-name.js"}`,
+		`# TYPE blogspam_plugin_errors_total counter`,
+		`# TYPE blogspam_redis_errors_total counter`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(rr.Body.String(), line) {
+			t.Errorf("Missing '%s' in:\n%s", line, rr.Body.String())
+		}
+	}
+}
+
+//
+// Verdicts are labelled with the siteKey of sites with a policy, or an
+// API key, and "other" otherwise.
+//
+func TestMetricSite(t *testing.T) {
+
+	withPolicyFile(t)
+	storePolicy("example.com", []byte(`{"min-size":10}`))
+
+	ctx := context.Background()
+	keyed := context.WithValue(ctx, apiSiteContextKey{}, "example.net")
+
+	tests := []struct {
+		ctx      context.Context
+		site     string
+		expected string
+	}{
+		{ctx, "https://Example.com/", "example.com"},
+		{ctx, "example.net", "other"},
+		{keyed, "http://example.net", "example.net"},
+		{keyed, "example.org", "other"},
+		{ctx, "", "other"},
+	}
+
+	for _, test := range tests {
+		if label := metricSite(test.ctx, test.site); label != test.expected {
+			t.Errorf("Unexpected label for '%s': %s", test.site, label)
+		}
+	}
+}
+
+//
+// Histograms count observations in each bucket they fall within.
+//
+func TestHistogram(t *testing.T) {
+
+	h := newHistogramVec("test_seconds", "Test.", []float64{0.1, 1}, "name")
+	h.observe(0.05, "a")
+	h.observe(0.5, "a")
+	h.observe(5, "a")
+	h.observe(1, "b\"")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{name="a",le="0.1"} 1
+test_seconds_bucket{name="a",le="1"} 2
+test_seconds_bucket{name="a",le="+Inf"} 3
+test_seconds_sum{name="a"} 5.55
+test_seconds_count{name="a"} 3
+test_seconds_bucket{name="b\"",le="0.1"} 0
+test_seconds_bucket{name="b\"",le="1"} 1
+test_seconds_bucket{name="b\"",le="+Inf"} 1
+test_seconds_sum{name="b\""} 1
+test_seconds_count{name="b\""} 1
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+}
+
+//
+// Plugin errors are counted.
+//
+func TestPluginErrorMetrics(t *testing.T) {
+
+	before := pluginErrors.get("99-broken.js")
+
+	observePlugins([]pluginOutcome{
+		{Plugin: BlogspamPlugin{Name: "99-broken.js"}, Result: Error, Duration: time.Second},
+		{Plugin: BlogspamPlugin{Name: "99-broken.js"}, Result: Undecided},
+	})
+
+	if after := pluginErrors.get("99-broken.js"); after != before+1 {
+		t.Errorf("Unexpected error count: %v", after)
+	}
+}
+
+//
+// Failed redis commands are counted, but missing keys are not.
+//
+func TestRedisMetrics(t *testing.T) {
+
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1",
+		MaxRetries: 0, DialTimeout: time.Second})
+	defer client.Close()
+	instrumentRedis(client)
+
+	before := redisErrors.get("get")
+
+	client.Get("missing")
+
+	pipe := client.Pipeline()
+	pipe.Get("missing")
+	pipe.Exec()
+
+	if after := redisErrors.get("get"); after != before+2 {
+		t.Errorf("Unexpected error count: %v", after)
+	}
+}
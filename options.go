@@ -0,0 +1,299 @@
+//
+//  The options of a submission.
+//
+//  Options may be supplied in the legacy form, a comma-separated
+// string of key=value pairs:
+//
+//    "options": "min-size=10,exclude=bayes,exclude=sfs"
+//
+//  As a JSON object, which allows values to contain commas and equals
+// signs, and keys which may be repeated to have array values:
+//
+//    "options": {"min-size": 10, "exclude": ["bayes", "sfs"]}
+//
+//  Or as a JSON array of key=value strings:
+//
+//    "options": ["min-size=10", "exclude=bayes", "exclude=sfs"]
+//
+//  Whatever the form they're parsed once, into the typed Options
+// structure, which is what plugins consume.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Options holds the parsed options of a submission.
+//
+type Options struct {
+	//
+	// Plugins to exclude, by name or partial name.
+	//
+	Exclude []string
+
+	//
+	// IP addresses, or CIDR ranges, to blacklist.
+	//
+	Blacklist []string
+
+	//
+	// Extra fields which must be present.
+	//
+	Mandatory []string
+
+	//
+	// The minimum and maximum size of the comment, if non-zero.
+	//
+	MinSize int
+	MaxSize int
+
+	//
+	// The maximum number of hyperlinks in the comment, if non-zero.
+	//
+	MaxLinks int
+
+	//
+	// The threshold to use for score-based verdicts, if non-zero.
+	//
+	ScoreThreshold float64
+
+	//
+	// Lists, from DNSBL zones combining several, to ignore.
+	//
+	IgnoreLists []string
+
+	//
+	// Should we explain our verdict?
+	//
+	Explain bool
+
+	//
+	// Problems parsing the values of known keys, by key.
+	//
+	// Plugins which use the values report these as errors.
+	//
+	Invalid map[string]string
+
+	//
+	// Any keys we didn't recognise.
+	//
+	Unknown []string
+}
+
+//
+// parseOptions parses options in the legacy comma-separated form.
+//
+func parseOptions(str string) Options {
+
+	var ret Options
+
+	for _, option := range strings.Split(str, ",") {
+		if len(option) == 0 {
+			continue
+		}
+		ret.setPair(option)
+	}
+
+	return ret
+}
+
+//
+// UnmarshalJSON parses options from a legacy string, a JSON object,
+// or a JSON array.
+//
+func (o *Options) UnmarshalJSON(data []byte) error {
+
+	*o = Options{}
+
+	//
+	// The legacy string.
+	//
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*o = parseOptions(str)
+		return nil
+	}
+
+	//
+	// An array of key=value strings.
+	//
+	// Unlike the legacy form each element holds a single option, so
+	// values may contain commas.
+	//
+	var array []string
+	if err := json.Unmarshal(data, &array); err == nil {
+		for _, option := range array {
+			if len(option) > 0 {
+				o.setPair(option)
+			}
+		}
+		return nil
+	}
+
+	//
+	// An object.
+	//
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("options must be a string, an array, or an object")
+	}
+
+	//
+	// Sort the keys, so that our results are stable.
+	//
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch value := object[key].(type) {
+		case []interface{}:
+			for _, v := range value {
+				o.set(key, optionString(v))
+			}
+		default:
+			o.set(key, optionString(value))
+		}
+	}
+	return nil
+}
+
+//
+// optionString converts a JSON value into the string we'd have seen
+// in the legacy form.
+//
+func optionString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+//
+// setPair stores an option of the form "key=value", or "key" alone,
+// splitting it at the first "=" only.
+//
+func (o *Options) setPair(option string) {
+
+	key := option
+	value := ""
+	if i := strings.Index(option, "="); i >= 0 {
+		key = option[:i]
+		value = option[i+1:]
+	}
+	o.set(key, value)
+}
+
+//
+// set stores the value of the given key.
+//
+func (o *Options) set(key string, value string) {
+
+	key = strings.ToLower(strings.TrimSpace(key))
+
+	switch key {
+	case "exclude":
+		o.Exclude = append(o.Exclude, value)
+	case "blacklist":
+		o.Blacklist = append(o.Blacklist, value)
+	case "mandatory":
+		o.Mandatory = append(o.Mandatory, value)
+	case "ignore-list":
+		o.IgnoreLists = append(o.IgnoreLists, value)
+	case "min-size":
+		o.MinSize = o.positive(key, value)
+	case "max-size":
+		o.MaxSize = o.positive(key, value)
+	case "max-links":
+		o.MaxLinks = o.positive(key, value)
+	case "score-threshold":
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 {
+			o.invalid(key, fmt.Sprintf("Failed to parse score-threshold '%s' as a positive number", value))
+			return
+		}
+		o.ScoreThreshold = threshold
+	case "explain":
+		switch strings.ToLower(value) {
+		case "", "1", "true", "yes":
+			o.Explain = true
+		default:
+			o.Explain = false
+		}
+	default:
+		o.Unknown = append(o.Unknown, key)
+	}
+}
+
+//
+// positive parses the value of the given key as a positive integer,
+// recording a problem if that isn't possible.
+//
+func (o *Options) positive(key string, value string) int {
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		o.invalid(key, fmt.Sprintf("Failed to parse %s as a number", key))
+		return 0
+	}
+	if i <= 0 {
+		o.invalid(key, fmt.Sprintf("Failed to parse %s as a positive number", key))
+		return 0
+	}
+	return i
+}
+
+//
+// invalid records a problem with the value of the given key.
+//
+func (o *Options) invalid(key string, detail string) {
+	if o.Invalid == nil {
+		o.Invalid = make(map[string]string)
+	}
+	o.Invalid[key] = detail
+}
+
+//
+// merge adds the given options to ours.
+//
+func (o *Options) merge(other Options) {
+
+	o.Exclude = append(o.Exclude, other.Exclude...)
+	o.Blacklist = append(o.Blacklist, other.Blacklist...)
+	o.Mandatory = append(o.Mandatory, other.Mandatory...)
+	o.IgnoreLists = append(o.IgnoreLists, other.IgnoreLists...)
+	o.Unknown = append(o.Unknown, other.Unknown...)
+
+	if other.MinSize != 0 {
+		o.MinSize = other.MinSize
+	}
+	if other.MaxSize != 0 {
+		o.MaxSize = other.MaxSize
+	}
+	if other.MaxLinks != 0 {
+		o.MaxLinks = other.MaxLinks
+	}
+	if other.ScoreThreshold != 0 {
+		o.ScoreThreshold = other.ScoreThreshold
+	}
+	if other.Explain {
+		o.Explain = true
+	}
+	for key, detail := range other.Invalid {
+		o.invalid(key, detail)
+	}
+}
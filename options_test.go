@@ -0,0 +1,109 @@
+//
+// Test for our option-parsing.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Test that the legacy, object, and array forms are equivalent.
+//
+func TestOptionsForms(t *testing.T) {
+
+	inputs := []string{
+		`"min-size=10,max-links=3,exclude=bayes,exclude=sfs,blacklist=1.2.3.4,mandatory=name,explain"`,
+		`{"min-size":10,"max-links":"3","exclude":["bayes","sfs"],"blacklist":"1.2.3.4","mandatory":["name"],"explain":true}`,
+		`["min-size=10","max-links=3","exclude=bayes","exclude=sfs","blacklist=1.2.3.4","mandatory=name","explain"]`,
+	}
+
+	expected := Options{
+		Exclude:   []string{"bayes", "sfs"},
+		Blacklist: []string{"1.2.3.4"},
+		Mandatory: []string{"name"},
+		MinSize:   10,
+		MaxLinks:  3,
+		Explain:   true,
+	}
+
+	for _, input := range inputs {
+		var options Options
+		err := json.Unmarshal([]byte(input), &options)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %s", input, err.Error())
+		}
+		if !reflect.DeepEqual(options, expected) {
+			t.Errorf("Unexpected options for %s: %+v", input, options)
+		}
+	}
+}
+
+//
+// Values in objects may contain commas, and equals signs.
+//
+func TestOptionsObjectValues(t *testing.T) {
+
+	var options Options
+	err := json.Unmarshal([]byte(`{"exclude":"a,b=c"}`), &options)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if len(options.Exclude) != 1 || options.Exclude[0] != "a,b=c" {
+		t.Errorf("Unexpected exclusions: %v", options.Exclude)
+	}
+}
+
+//
+// Values in arrays may contain commas, and equals signs.
+//
+func TestOptionsArrayValues(t *testing.T) {
+
+	var options Options
+	err := json.Unmarshal([]byte(`["exclude=a,b", "blacklist=x=y", "explain"]`), &options)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(options.Exclude, []string{"a,b"}) {
+		t.Errorf("Unexpected exclusions: %v", options.Exclude)
+	}
+	if !reflect.DeepEqual(options.Blacklist, []string{"x=y"}) {
+		t.Errorf("Unexpected blacklist: %v", options.Blacklist)
+	}
+	if !options.Explain || len(options.Unknown) != 0 {
+		t.Errorf("Unexpected options: %+v", options)
+	}
+}
+
+//
+// Test that unknown keys, and bogus values, are recorded.
+//
+func TestOptionsProblems(t *testing.T) {
+
+	options := parseOptions("colour=red,max-size=pi,min-size=-1,score-threshold=0")
+
+	if !reflect.DeepEqual(options.Unknown, []string{"colour"}) {
+		t.Errorf("Unexpected unknown keys: %v", options.Unknown)
+	}
+	for _, key := range []string{"max-size", "min-size", "score-threshold"} {
+		if !strings.Contains(options.Invalid[key], "Failed to parse") {
+			t.Errorf("Missing problem for %s: %v", key, options.Invalid)
+		}
+	}
+}
+
+//
+// Options of the wrong type are an error.
+//
+func TestOptionsBogus(t *testing.T) {
+
+	var options Options
+	err := json.Unmarshal([]byte(`3`), &options)
+	if err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+}
@@ -0,0 +1,266 @@
+//
+//  Per-site policies.
+//
+//  Rather than every client sending the same options with every
+// submission a site may have a policy stored on the server.  A policy
+// is a set of options, in any of the forms described in options.go,
+// which are merged with the options of each submission for that site.
+//
+//  Options supplied with a submission take precedence over those of
+// the policy, and lists such as "exclude" are combined.
+//
+//  Policies are stored in redis, if it is available, beneath the key
+// `site-$site-policy`.  Otherwise they're stored in a JSON file, which
+// maps each site to its policy:
+//
+//    {"example.com": {"min-size": 10, "mandatory": "email"}}
+//
+//  They may be managed via the admin-token protected end-point:
+//
+//    GET /sites/{site}/policy
+//    PUT /sites/{site}/policy
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+)
+
+//
+// The file we store policies within, if redis is not available.
+//
+// This may be changed via the `-policy-file` flag.
+//
+var policyFile = "./policies.json"
+
+//
+// The policies loaded from our file, indexed by siteKey.
+//
+var (
+	filePolicies     = make(map[string]json.RawMessage)
+	filePoliciesLock sync.RWMutex
+)
+
+//
+// loadPolicies reads the policies from our file, if it exists.
+//
+func loadPolicies() error {
+
+	policies := make(map[string]json.RawMessage)
+
+	data, err := ioutil.ReadFile(policyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		var raw map[string]json.RawMessage
+		err = json.Unmarshal(data, &raw)
+		if err != nil {
+			return fmt.Errorf("%s: %s", policyFile, err.Error())
+		}
+		for site, policy := range raw {
+			policies[siteKey(site)] = policy
+		}
+	}
+
+	filePoliciesLock.Lock()
+	filePolicies = policies
+	filePoliciesLock.Unlock()
+	return nil
+}
+
+//
+// sitePolicy returns the stored policy of the given site, in the form
+// it was supplied, or nil if there is no policy.
+//
+func sitePolicy(site string) (json.RawMessage, error) {
+
+	if redisHandle != nil {
+		key := fmt.Sprintf("site-%s-policy", siteKey(site))
+		result, err := redisHandle.Get(key).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(result), nil
+	}
+
+	filePoliciesLock.RLock()
+	defer filePoliciesLock.RUnlock()
+	return filePolicies[siteKey(site)], nil
+}
+
+//
+// storePolicy saves the policy of the given site.
+//
+func storePolicy(site string, policy json.RawMessage) error {
+
+	if redisHandle != nil {
+		key := fmt.Sprintf("site-%s-policy", siteKey(site))
+		return redisHandle.Set(key, string(policy), 0).Err()
+	}
+
+	filePoliciesLock.Lock()
+	defer filePoliciesLock.Unlock()
+
+	//
+	// Update a copy, so that we don't change what is in memory
+	// unless we could write the file.
+	//
+	policies := make(map[string]json.RawMessage)
+	for key, val := range filePolicies {
+		policies[key] = val
+	}
+	policies[siteKey(site)] = policy
+
+	data, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(policyFile, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	filePolicies = policies
+	return nil
+}
+
+//
+// applyPolicy returns the options of the given submission merged with
+// the policy of its site, if any.
+//
+func applyPolicy(input Submission) Options {
+
+	policy, err := sitePolicy(input.Site)
+	if err != nil {
+		fmt.Printf("WARNING - Failed to fetch policy for %s - %s\n", input.Site, err.Error())
+		return input.Options
+	}
+	if policy == nil {
+		return input.Options
+	}
+
+	var ret Options
+	err = json.Unmarshal(policy, &ret)
+	if err != nil {
+		fmt.Printf("WARNING - Ignoring invalid policy for %s - %s\n", input.Site, err.Error())
+		return input.Options
+	}
+
+	ret.merge(input.Options)
+	return ret
+}
+
+//
+// validatePolicy ensures that the given policy contains only options
+// we recognise, with valid values.
+//
+func validatePolicy(policy json.RawMessage) error {
+
+	var options Options
+	err := json.Unmarshal(policy, &options)
+	if err != nil {
+		return err
+	}
+
+	if len(options.Unknown) > 0 {
+		return fmt.Errorf("Unknown option(s): %s", strings.Join(options.Unknown, ","))
+	}
+	for _, detail := range options.Invalid {
+		return errors.New(detail)
+	}
+	return nil
+}
+
+//
+// SitePolicyHandler is a HTTP-handler which retrieves, or replaces,
+// the policy of a site.
+//
+func SitePolicyHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+			// Don't spam stdout when running test-cases.
+			if flag.Lookup("test.v") == nil {
+				fmt.Printf("WARNING - Error returned from /sites handler - %s\n", err.Error())
+			}
+		}
+	}()
+
+	site := mux.Vars(req)["site"]
+
+	switch req.Method {
+	case "GET":
+		// Nop
+
+	case "PUT":
+		var policy json.RawMessage
+		err = json.NewDecoder(req.Body).Decode(&policy)
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+
+		err = validatePolicy(policy)
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+
+		err = storePolicy(site, policy)
+		if err != nil {
+			status = http.StatusInternalServerError
+			return
+		}
+
+	default:
+		err = errors.New("Must be called via HTTP-GET, or PUT")
+		status = http.StatusMethodNotAllowed
+		return
+	}
+
+	//
+	// Return the current policy.
+	//
+	policy, err := sitePolicy(site)
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+	if policy == nil {
+		err = fmt.Errorf("No policy for site '%s'", site)
+		status = http.StatusNotFound
+		return
+	}
+
+	jsonString, err := json.Marshal(map[string]interface{}{
+		"site":   site,
+		"policy": policy,
+	})
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(res, "%s", jsonString)
+}
@@ -0,0 +1,127 @@
+//
+// Test for our per-site policies.
+//
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// Use a temporary policy-file for the duration of a test.
+//
+func withPolicyFile(t *testing.T) {
+
+	saved := policyFile
+	policyFile = filepath.Join(t.TempDir(), "policies.json")
+	loadPolicies()
+
+	t.Cleanup(func() {
+		policyFile = saved
+		loadPolicies()
+	})
+}
+
+//
+// Test that policies are merged with the options of a submission.
+//
+func TestPolicyApply(t *testing.T) {
+
+	withPolicyFile(t)
+
+	err := storePolicy("https://Example.com/", []byte(`{"min-size":10,"max-links":3,"exclude":"sfs"}`))
+	if err != nil {
+		t.Fatalf("Failed to store policy: %s", err.Error())
+	}
+
+	options := applyPolicy(Submission{Site: "example.com",
+		Options: parseOptions("max-links=5,exclude=bayes")})
+
+	if options.MinSize != 10 {
+		t.Errorf("Policy min-size was not applied: %+v", options)
+	}
+	if options.MaxLinks != 5 {
+		t.Errorf("Submission max-links did not take precedence: %+v", options)
+	}
+	if strings.Join(options.Exclude, ",") != "sfs,bayes" {
+		t.Errorf("Unexpected exclusions: %v", options.Exclude)
+	}
+
+	//
+	// Other sites are unaffected.
+	//
+	options = applyPolicy(Submission{Site: "example.org"})
+	if options.MinSize != 0 {
+		t.Errorf("Policy applied to the wrong site: %+v", options)
+	}
+
+	//
+	// The policy survives a reload.
+	//
+	loadPolicies()
+	options = applyPolicy(Submission{Site: "example.com"})
+	if options.MinSize != 10 {
+		t.Errorf("Policy was not persisted: %+v", options)
+	}
+
+	//
+	// And the plugins see it.
+	//
+	result, err := testSubmission(context.Background(), Submission{Site: "example.com", IP: "127.0.0.1", Comment: "Short",
+		Options: parseOptions("exclude=80-sfs")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !result.Spam || result.Blocker.Name != "40-size.js" {
+		t.Errorf("Unexpected verdict: %+v", result)
+	}
+}
+
+//
+// Test the policy end-point.
+//
+func TestPolicyHandler(t *testing.T) {
+
+	withPolicyFile(t)
+
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+
+	rr := adminRequest(t, "PUT", "/sites/example.com/policy", `"min-size=10"`, "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	rr = adminRequest(t, "GET", "/sites/example.com/policy", "", "secret")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	//
+	// Bogus policies are rejected.
+	//
+	for _, body := range []string{`3`, `"colour=red"`, `{"min-size":"pi"}`, `{`} {
+		rr = adminRequest(t, "PUT", "/sites/example.com/policy", body, "secret")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status-code for %s: %v", body, rr.Code)
+		}
+	}
+
+	rr = adminRequest(t, "PUT", "/sites/example.com/policy", `{"mandatory":"email"}`, "secret")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	rr = adminRequest(t, "GET", "/sites/example.com/policy", "", "secret")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"policy":{"mandatory":"email"}`) {
+		t.Errorf("Unexpected body: %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,138 @@
+//
+//  Rate-limiting of the API itself.
+//
+//  To protect the server each client, identified by the address it
+// connects from, may make a limited number of requests per second.  We
+// use a token bucket, so that short bursts are permitted.
+//
+//  Clients which exceed the limit receive a "429 Too Many Requests"
+// response.
+//
+
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// The number of requests per second each client may make, zero to
+// disable rate-limiting.
+//
+// This may be changed via the `-rate-limit` flag.
+//
+var rateLimit float64
+
+//
+// The number of requests a client may burst above the rate.
+//
+// This may be changed via the `-rate-burst` flag.
+//
+var rateBurst = 20
+
+//
+// rateBucket holds the tokens available to a single client.
+//
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//
+// The buckets of each client, and when we last forgot those which
+// were full.
+//
+var (
+	rateBuckets = make(map[string]*rateBucket)
+	rateSwept   time.Time
+	rateLock    sync.Mutex
+)
+
+//
+// How often we forget the clients whose buckets are full.
+//
+// Sweeping every bucket is proportional to the number of clients, so
+// we do it periodically rather than upon each request.
+//
+const rateSweepInterval = time.Minute
+
+//
+// rateAllow consumes a token from the bucket of the given client,
+// returning false, and the time until a token will be available, if
+// there are none.
+//
+func rateAllow(client string, now time.Time) (bool, time.Duration) {
+
+	rateLock.Lock()
+	defer rateLock.Unlock()
+
+	burst := float64(rateBurst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	bucket, ok := rateBuckets[client]
+	if !ok {
+		bucket = &rateBucket{tokens: burst, last: now}
+		rateBuckets[client] = bucket
+	}
+
+	//
+	// Refill the bucket for the time which has passed.
+	//
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rateLimit)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rateLimit * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+
+	//
+	// Periodically forget any clients whose buckets would now be
+	// full, so that we don't grow without bound.
+	//
+	if now.Sub(rateSwept) >= rateSweepInterval {
+		rateSwept = now
+		for other, b := range rateBuckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rateLimit >= burst {
+				delete(rateBuckets, other)
+			}
+		}
+	}
+	return true, 0
+}
+
+//
+// rateLimiter is middleware which rejects requests from clients which
+// have exceeded their rate.
+//
+func rateLimiter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		if rateLimit <= 0 {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		client, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			client = req.RemoteAddr
+		}
+
+		ok, wait := rateAllow(client, time.Now())
+		if !ok {
+			res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(res, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
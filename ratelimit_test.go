@@ -0,0 +1,103 @@
+//
+// Test for our rate-limiting.
+//
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//
+// Test that buckets empty, and refill.
+//
+func TestRateAllow(t *testing.T) {
+
+	savedRate, savedBurst := rateLimit, rateBurst
+	rateLimit, rateBurst = 2, 3
+	defer func() {
+		rateLimit, rateBurst = savedRate, savedBurst
+	}()
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := rateAllow("client", now); !ok {
+			t.Errorf("Request %d was rejected", i)
+		}
+	}
+
+	ok, wait := rateAllow("client", now)
+	if ok {
+		t.Errorf("Request exceeding the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Unexpected wait: %s", wait)
+	}
+
+	if ok, _ := rateAllow("other", now); !ok {
+		t.Errorf("Another client was rejected")
+	}
+
+	if ok, _ := rateAllow("client", now.Add(wait)); !ok {
+		t.Errorf("Request was rejected after waiting")
+	}
+}
+
+//
+// Test that idle clients are forgotten, but only periodically.
+//
+func TestRateSweep(t *testing.T) {
+
+	savedRate, savedBurst := rateLimit, rateBurst
+	rateLimit, rateBurst = 1, 1
+	defer func() {
+		rateLimit, rateBurst = savedRate, savedBurst
+	}()
+
+	now := time.Now()
+	rateAllow("idle", now)
+	rateAllow("busy", now.Add(rateSweepInterval/2))
+
+	rateLock.Lock()
+	_, idle := rateBuckets["idle"]
+	rateLock.Unlock()
+	if !idle {
+		t.Errorf("Client was forgotten before the sweep interval")
+	}
+
+	rateAllow("busy", now.Add(2*rateSweepInterval))
+
+	rateLock.Lock()
+	_, idle = rateBuckets["idle"]
+	rateLock.Unlock()
+	if idle {
+		t.Errorf("Idle client was not forgotten")
+	}
+}
+
+//
+// Test that our router rejects clients exceeding their rate.
+//
+func TestRateLimiter(t *testing.T) {
+
+	savedRate, savedBurst := rateLimit, rateBurst
+	rateLimit, rateBurst = 1, 1
+	defer func() {
+		rateLimit, rateBurst = savedRate, savedBurst
+	}()
+
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, code := range codes {
+		req, _ := http.NewRequest("GET", "/plugins", nil)
+		req.RemoteAddr = "192.0.2.10:1234"
+
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Errorf("Unexpected status-code: %v", rr.Code)
+		}
+	}
+}
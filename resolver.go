@@ -0,0 +1,128 @@
+//
+//  DNS resolution for our plugins.
+//
+//  Every plugin which makes DNS lookups does so via the global resolver,
+// rather than calling the net-package directly.  This allows the server
+// to be pointed at a dedicated resolver, via the `-resolver` flag, and
+// allows our tests to use canned answers.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+//
+// Resolver is the interface of something which can make DNS lookups.
+//
+// The *net.Resolver type implements this.
+//
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+//
+// The resolver our plugins use.
+//
+var resolver Resolver = net.DefaultResolver
+
+//
+// newResolver returns a resolver which sends its queries to the given
+// server, rather than those the system is configured to use.
+//
+// Each query times out after the given duration, and failed queries
+// are retried the given number of times.
+//
+func newResolver(server string, timeout time.Duration, retries int) Resolver {
+
+	dialer := net.Dialer{Timeout: timeout}
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+
+	return &retryResolver{resolver: r, timeout: timeout, retries: retries}
+}
+
+//
+// retryResolver wraps a resolver, bounding the time taken by each
+// query and retrying those which fail for reasons other than the name
+// not existing.
+//
+type retryResolver struct {
+	resolver Resolver
+	timeout  time.Duration
+	retries  int
+}
+
+//
+// retry invokes the given query until it succeeds, the name is found to
+// not exist, or we run out of retries.
+//
+func (r *retryResolver) retry(ctx context.Context, query func(ctx context.Context) error) error {
+
+	var err error
+
+	for attempt := 0; attempt <= r.retries; attempt++ {
+
+		qctx := ctx
+		cancel := func() {}
+		if r.timeout > 0 {
+			qctx, cancel = context.WithTimeout(ctx, r.timeout)
+		}
+		err = query(qctx)
+		cancel()
+
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		if isNotFound(err) {
+			return err
+		}
+	}
+	return err
+}
+
+//
+// isNotFound returns true if the given error reports that a name does
+// not exist, rather than that the lookup failed.
+//
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+//
+// LookupHost returns the addresses of the given host.
+//
+func (r *retryResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	var ret []string
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		ret, err = r.resolver.LookupHost(ctx, host)
+		return err
+	})
+	return ret, err
+}
+
+//
+// LookupMX returns the MX records of the given domain.
+//
+func (r *retryResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	var ret []*net.MX
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		ret, err = r.resolver.LookupMX(ctx, name)
+		return err
+	})
+	return ret, err
+}
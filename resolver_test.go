@@ -0,0 +1,126 @@
+//
+// Test for our resolver.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+//
+// fakeResolver returns canned answers.
+//
+// Names which have no answer are reported as not existing.
+//
+type fakeResolver struct {
+	hosts map[string][]string
+	mx    map[string][]*net.MX
+
+	// Fail this many queries, temporarily, before answering.
+	failures int
+
+	// The number of queries made.
+	queries int
+
+	lock sync.Mutex
+}
+
+//
+// answer counts a query, returning an error if it should fail.
+//
+func (f *fakeResolver) answer(name string, found bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.queries++
+	if f.queries <= f.failures {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if !found {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil
+}
+
+//
+// LookupHost returns the canned addresses of the given host.
+//
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ret, ok := f.hosts[host]
+	if err := f.answer(host, ok); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//
+// LookupMX returns the canned MX records of the given domain.
+//
+func (f *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	ret, ok := f.mx[name]
+	if err := f.answer(name, ok); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//
+// withResolver uses the given resolver for the duration of a test.
+//
+func withResolver(t *testing.T, r Resolver) {
+	saved := resolver
+	resolver = r
+	resetCache()
+	t.Cleanup(func() {
+		resolver = saved
+		resetCache()
+	})
+}
+
+//
+// Test that temporary failures are retried, and others are not.
+//
+func TestResolverRetry(t *testing.T) {
+
+	fake := &fakeResolver{hosts: map[string][]string{"example.com": {"192.0.2.1"}}, failures: 2}
+	r := &retryResolver{resolver: fake, retries: 2}
+
+	addrs, err := r.LookupHost(context.Background(), "example.com")
+	if err != nil || len(addrs) != 1 {
+		t.Errorf("Unexpected result: %v %v", addrs, err)
+	}
+	if fake.queries != 3 {
+		t.Errorf("Unexpected number of queries: %d", fake.queries)
+	}
+
+	//
+	// Running out of retries returns the error.
+	//
+	fake = &fakeResolver{failures: 5}
+	r = &retryResolver{resolver: fake, retries: 2}
+
+	_, err = r.LookupMX(context.Background(), "example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTemporary {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if fake.queries != 3 {
+		t.Errorf("Unexpected number of queries: %d", fake.queries)
+	}
+
+	//
+	// Names which don't exist aren't retried.
+	//
+	fake = &fakeResolver{}
+	r = &retryResolver{resolver: fake, retries: 2}
+
+	_, err = r.LookupHost(context.Background(), "example.com")
+	if err == nil || fake.queries != 1 {
+		t.Errorf("Unexpected result: %v after %d queries", err, fake.queries)
+	}
+}
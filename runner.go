@@ -0,0 +1,193 @@
+//
+//  Run our plugins against a submission.
+//
+//  Plugins which are purely local run first, one after another, since
+//  they are cheap.  Plugins which make network requests are then run
+//  concurrently, under a single deadline, so that a slow resolver or
+//  remote service cannot hold up a submission for long.
+//
+//  Regardless of the order in which they complete the results are
+//  merged in plugin-order, so that verdicts are deterministic.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//
+// The maximum time we'll wait for network-plugins to complete.
+//
+// This may be changed via the `-network-timeout` flag.
+//
+var networkTimeout = 5 * time.Second
+
+//
+// pluginOutcome holds the result of running a single plugin.
+//
+type pluginOutcome struct {
+	//
+	// The plugin which was invoked.
+	//
+	Plugin BlogspamPlugin
+
+	//
+	// The result it returned.
+	//
+	Result PluginResult
+
+	//
+	// The detail it returned.
+	//
+	Detail string
+
+	//
+	// How long the plugin took to run.
+	//
+	Duration time.Duration
+}
+
+//
+// runPlugins invokes each plugin which has not been excluded against
+// the given submission, returning their outcomes in plugin-order.
+//
+// The given context is passed to each plugin, and the network-plugins
+// additionally have our deadline applied.
+//
+// If decide is true the outcomes are truncated after the first plugin
+// to return either Spam or Ham, and we avoid running plugins that
+// cannot change that verdict.
+//
+func runPlugins(ctx context.Context, input Submission, exclude []string, decide bool) []pluginOutcome {
+
+	var outcomes []pluginOutcome
+
+	//
+	// The index of the first local plugin to reach a verdict.
+	//
+	decided := -1
+
+	//
+	// Run the local plugins first.
+	//
+	for _, obj := range plugins {
+
+		if isExcluded(obj.Name, exclude) {
+			continue
+		}
+
+		outcome := pluginOutcome{Plugin: obj, Result: Undecided}
+		if !obj.Network && (!decide || decided < 0) {
+			start := time.Now()
+			outcome.Result, outcome.Detail = obj.run(ctx, input)
+			outcome.Duration = time.Since(start)
+
+			if decided < 0 && (outcome.Result == Spam || outcome.Result == Ham) {
+				decided = len(outcomes)
+			}
+		}
+		outcomes = append(outcomes, outcome)
+	}
+
+	//
+	// If a local plugin reached a verdict then only the network
+	// plugins which come before it could change that.
+	//
+	if decide && decided >= 0 {
+		outcomes = outcomes[:decided+1]
+	}
+
+	//
+	// Now launch the network plugins, concurrently.
+	//
+	ctx, cancel := context.WithTimeout(ctx, networkTimeout)
+	defer cancel()
+
+	launched := time.Now()
+
+	type reply struct {
+		index    int
+		result   PluginResult
+		detail   string
+		duration time.Duration
+	}
+	replies := make(chan reply, len(outcomes))
+	pending := 0
+
+	for i, outcome := range outcomes {
+		if !outcome.Plugin.Network {
+			continue
+		}
+
+		pending++
+		go func(index int, obj BlogspamPlugin) {
+			start := time.Now()
+			result, detail := obj.run(ctx, input)
+			replies <- reply{index: index, result: result, detail: detail,
+				duration: time.Since(start)}
+		}(i, outcome.Plugin)
+	}
+
+	//
+	// Collect the results of those that complete in time.
+	//
+	completed := make([]bool, len(outcomes))
+
+	for pending > 0 {
+		select {
+		case r := <-replies:
+			outcomes[r.index].Result = r.result
+			outcomes[r.index].Detail = r.detail
+			outcomes[r.index].Duration = r.duration
+			completed[r.index] = true
+			pending--
+		case <-ctx.Done():
+			pending = 0
+		}
+	}
+
+	//
+	// Any network-plugins which didn't complete have failed.
+	//
+	for i := range outcomes {
+		if outcomes[i].Plugin.Network && !completed[i] {
+			outcomes[i].Duration = time.Since(launched)
+			outcomes[i].Result = Error
+			outcomes[i].Detail = ctx.Err().Error()
+
+			if ctx.Err() == context.DeadlineExceeded {
+				outcomes[i].Detail = fmt.Sprintf("Timed out after %s", networkTimeout)
+			}
+		}
+	}
+
+	//
+	// Every plugin in our outcomes was run, so record their timings.
+	//
+	observePlugins(outcomes)
+
+	//
+	// Report on the results, and truncate after the first verdict
+	// if we should.
+	//
+	for i, outcome := range outcomes {
+
+		if verbose {
+			fmt.Printf("Plugin %s returned: %s %s\n",
+				outcome.Plugin.Name, outcome.Result, outcome.Detail)
+		}
+		if outcome.Result == Error {
+			fmt.Printf("Error running plugin: %s\n\t%s\n",
+				outcome.Plugin.Name, outcome.Detail)
+		}
+
+		if decide && (outcome.Result == Spam || outcome.Result == Ham) {
+			return outcomes[:i+1]
+		}
+	}
+
+	return outcomes
+}
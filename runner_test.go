@@ -0,0 +1,132 @@
+//
+// Test for our plugin-runner.
+//
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//
+// Replace the registered plugins for the duration of a test.
+//
+func withPlugins(t *testing.T, replacement []BlogspamPlugin) {
+	saved := plugins
+	plugins = replacement
+	t.Cleanup(func() { plugins = saved })
+}
+
+//
+// Build a plugin which returns the given result after a delay.
+//
+func fakePlugin(name string, network bool, delay time.Duration, result PluginResult) BlogspamPlugin {
+	return BlogspamPlugin{Name: name,
+		Network: network,
+		Test: func(x Submission) (PluginResult, string) {
+			time.Sleep(delay)
+			return result, name
+		}}
+}
+
+//
+// A slow network plugin which decides before a local plugin must win.
+//
+func TestRunnerOrder(t *testing.T) {
+
+	withPlugins(t, []BlogspamPlugin{
+		fakePlugin("10-local.js", false, 0, Undecided),
+		fakePlugin("20-network.js", true, 50*time.Millisecond, Spam),
+		fakePlugin("30-fast.js", true, 0, Ham),
+		fakePlugin("40-local.js", false, 0, Ham),
+		fakePlugin("50-network.js", true, 0, Spam),
+	})
+
+	outcomes := runPlugins(context.Background(), Submission{}, nil, true)
+
+	if len(outcomes) != 2 {
+		t.Fatalf("Unexpected outcomes: %v", outcomes)
+	}
+	if outcomes[1].Plugin.Name != "20-network.js" || outcomes[1].Result != Spam {
+		t.Errorf("Unexpected verdict: %v", outcomes[1])
+	}
+}
+
+//
+// All plugins run when we're not deciding, and exclusions are honoured.
+//
+func TestRunnerAll(t *testing.T) {
+
+	withPlugins(t, []BlogspamPlugin{
+		fakePlugin("10-local.js", false, 0, Spam),
+		fakePlugin("20-network.js", true, 0, Spam),
+		fakePlugin("30-local.js", false, 0, Ham),
+	})
+
+	outcomes := runPlugins(context.Background(), Submission{}, []string{"30-local"}, false)
+
+	if len(outcomes) != 2 {
+		t.Fatalf("Unexpected outcomes: %v", outcomes)
+	}
+	for _, outcome := range outcomes {
+		if outcome.Result != Spam {
+			t.Errorf("Unexpected result: %v", outcome)
+		}
+	}
+}
+
+//
+// Network plugins which don't complete in time are reported as errors.
+//
+func TestRunnerTimeout(t *testing.T) {
+
+	withPlugins(t, []BlogspamPlugin{
+		fakePlugin("10-network.js", true, time.Second, Spam),
+		fakePlugin("20-network.js", true, 0, Undecided),
+	})
+
+	saved := networkTimeout
+	networkTimeout = 50 * time.Millisecond
+	defer func() { networkTimeout = saved }()
+
+	outcomes := runPlugins(context.Background(), Submission{}, nil, true)
+
+	if len(outcomes) != 2 {
+		t.Fatalf("Unexpected outcomes: %v", outcomes)
+	}
+	if outcomes[0].Result != Error {
+		t.Errorf("Unexpected result: %v", outcomes[0])
+	}
+	if outcomes[1].Result != Undecided {
+		t.Errorf("Unexpected result: %v", outcomes[1])
+	}
+}
+
+//
+// Context-aware plugins see the cancellation of the request.
+//
+func TestRunnerCancelled(t *testing.T) {
+
+	withPlugins(t, []BlogspamPlugin{
+		{Name: "10-network.js",
+			Network: true,
+			ContextTest: func(ctx context.Context, x Submission) (PluginResult, string) {
+				<-ctx.Done()
+				return Error, ctx.Err().Error()
+			}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	outcomes := runPlugins(ctx, Submission{}, nil, true)
+
+	if len(outcomes) != 1 {
+		t.Fatalf("Unexpected outcomes: %v", outcomes)
+	}
+	if outcomes[0].Result != Error || outcomes[0].Detail != "context canceled" {
+		t.Errorf("Unexpected result: %v", outcomes[0])
+	}
+}
@@ -0,0 +1,122 @@
+//
+//  Score-based verdicts.
+//
+//  By default the first plugin which returns Spam, or Ham, decides the
+// fate of a submission.  If the caller supplies a threshold via the
+// options, for example "score-threshold=2.5", then we instead run every
+// plugin and sum their weighted contributions:
+//
+//    Spam adds the weight of the plugin to the score.
+//    Ham subtracts the weight of the plugin from the score.
+//    Undecided, and Error, contribute nothing.
+//
+//  If the total reaches the threshold the submission is SPAM.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+//
+// scoreThreshold looks for a "score-threshold" in the given options.
+//
+// The boolean return value will be true if one was found, and scoring
+// should be used.
+//
+func scoreThreshold(options Options) (float64, bool, error) {
+
+	if detail, ok := options.Invalid["score-threshold"]; ok {
+		return 0, false, errors.New(detail)
+	}
+
+	if options.ScoreThreshold > 0 {
+		return options.ScoreThreshold, true, nil
+	}
+	return 0, false, nil
+}
+
+//
+// pluginWeight returns the weight of the given plugin.
+//
+func pluginWeight(plugin BlogspamPlugin) float64 {
+	if plugin.Weight == 0 {
+		return 1
+	}
+	return plugin.Weight
+}
+
+//
+// scoreContribution returns the amount the given result, from the given
+// plugin, adds to the score of a submission.
+//
+func scoreContribution(plugin BlogspamPlugin, result PluginResult) float64 {
+	switch result {
+	case Spam:
+		return pluginWeight(plugin)
+	case Ham:
+		return -pluginWeight(plugin)
+	}
+	return 0
+}
+
+//
+// scoreOutcomes returns a verdict based upon the total score of the
+// given plugin-outcomes.
+//
+// The contribution of each plugin is included in the response, to
+// allow weights to be tuned.
+//
+func scoreOutcomes(outcomes []pluginOutcome, threshold float64) verdict {
+
+	total := 0.0
+	scores := make(map[string]float64)
+
+	//
+	// The plugin which contributed the most, and its detail.
+	//
+	var blocker BlogspamPlugin
+	var reason string
+
+	//
+	// The detail of any plugin whose SPAM-result should be cached.
+	//
+	var cache string
+
+	for _, outcome := range outcomes {
+
+		obj := outcome.Plugin
+		result := outcome.Result
+		detail := outcome.Detail
+
+		contribution := scoreContribution(obj, result)
+		scores[obj.Name] = contribution
+		total += contribution
+
+		if contribution > 0 && contribution > scores[blocker.Name] {
+			blocker = obj
+			reason = detail
+		}
+		if result == Spam && obj.caches(detail) {
+			cache = detail
+		}
+	}
+
+	extra := map[string]interface{}{
+		"score":     total,
+		"threshold": threshold,
+		"scores":    scores,
+	}
+
+	if total >= threshold {
+		return verdict{Spam: true,
+			Blocker: blocker,
+			Reason:  fmt.Sprintf("Score %.2f reached threshold %.2f: %s", total, threshold, reason),
+			Cache:   cache,
+			Extra:   extra}
+	}
+
+	return verdict{Extra: extra}
+}
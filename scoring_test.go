@@ -0,0 +1,71 @@
+//
+// Test for our score-based verdicts.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+//
+// Test that we find thresholds, and reject bogus ones.
+//
+func TestScoreThreshold(t *testing.T) {
+
+	type TestCase struct {
+		Options   string
+		Threshold float64
+		Scoring   bool
+		Error     bool
+	}
+
+	tests := []TestCase{
+		{"", 0, false, false},
+		{"exclude=name", 0, false, false},
+		{"score-threshold=2.5", 2.5, true, false},
+		{"exclude=name,score-threshold=3", 3, true, false},
+		{"score-threshold=pi", 0, false, true},
+		{"score-threshold=-1", 0, false, true},
+	}
+
+	for _, test := range tests {
+
+		threshold, scoring, err := scoreThreshold(parseOptions(test.Options))
+
+		if test.Error != (err != nil) {
+			t.Errorf("Unexpected error for '%s': %v", test.Options, err)
+		}
+		if threshold != test.Threshold {
+			t.Errorf("Unexpected threshold for '%s': %v", test.Options, threshold)
+		}
+		if scoring != test.Scoring {
+			t.Errorf("Unexpected scoring for '%s': %v", test.Options, scoring)
+		}
+	}
+}
+
+//
+// Test the contributions of results, and default weights.
+//
+func TestScoreContribution(t *testing.T) {
+
+	plain := BlogspamPlugin{Name: "plain"}
+	heavy := BlogspamPlugin{Name: "heavy", Weight: 3}
+
+	if scoreContribution(plain, Spam) != 1 {
+		t.Errorf("Unexpected contribution for default weight")
+	}
+	if scoreContribution(heavy, Spam) != 3 {
+		t.Errorf("Unexpected contribution for spam")
+	}
+	if scoreContribution(heavy, Ham) != -3 {
+		t.Errorf("Unexpected contribution for ham")
+	}
+	if scoreContribution(heavy, Undecided) != 0 {
+		t.Errorf("Unexpected contribution for undecided")
+	}
+	if scoreContribution(heavy, Error) != 0 {
+		t.Errorf("Unexpected contribution for error")
+	}
+}
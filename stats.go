@@ -0,0 +1,315 @@
+//
+//  Time-series statistics.
+//
+//  As well as the lifetime counts of SPAM and ham, globally and per-site,
+// we count verdicts in hourly and daily buckets, along with the plugin
+// which blocked each SPAM submission.  This allows site owners to see
+// when a wave of SPAM started, and which plugin caught it.
+//
+//  Each bucket is a redis hash, if redis is available, otherwise it is
+// held in memory:
+//
+//    stats-global-hour-1551441600       {"spam": 3, "ok": 12,
+//    stats-site-example.com-day-...      "blocker-35-name.js": 2, ...}
+//
+//  Buckets expire once they're older than the retention period of their
+// granularity.  Without redis we only keep the buckets of sites with an
+// API key, or a policy, see recordVerdict.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//
+// How long hourly buckets are kept.
+//
+// This may be changed via the `-stats-hourly-retention` flag.
+//
+var statsHourlyRetention = 14 * 24 * time.Hour
+
+//
+// How long daily buckets are kept.
+//
+// This may be changed via the `-stats-daily-retention` flag.
+//
+var statsDailyRetention = 400 * 24 * time.Hour
+
+//
+// The maximum number of buckets a caller may request at once.
+//
+const statsMaxBuckets = 1000
+
+//
+// The size of the buckets of each granularity.
+//
+var statsGranularities = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+//
+// The buckets held in memory, if redis is not available, along with
+// the time each expires.
+//
+var (
+	statsBuckets = make(map[string]map[string]int64)
+	statsExpiry  = make(map[string]time.Time)
+	statsSwept   time.Time
+	statsLock    sync.Mutex
+)
+
+//
+// How often we drop the buckets held in memory which have expired.
+//
+const statsSweepInterval = time.Hour
+
+//
+// statsQuery is a request for a series of buckets.
+//
+type statsQuery struct {
+	From        time.Time
+	To          time.Time
+	Granularity string
+}
+
+//
+// statsRetention returns the time buckets of the given granularity are
+// kept for.
+//
+func statsRetention(granularity string) time.Duration {
+	if granularity == "day" {
+		return statsDailyRetention
+	}
+	return statsHourlyRetention
+}
+
+//
+// statsKey returns the key of the bucket of the given scope, and
+// granularity, starting at the given time.
+//
+func statsKey(scope string, granularity string, bucket time.Time) string {
+	return fmt.Sprintf("stats-%s-%s-%d", scope, granularity, bucket.Unix())
+}
+
+//
+// parseStatsTime parses a time given as RFC3339, a date, or seconds
+// since the epoch.
+//
+func parseStatsTime(str string) (time.Time, error) {
+
+	if secs, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", str); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Failed to parse '%s' as a time", str)
+}
+
+//
+// parseStatsQuery parses the given range and granularity.
+//
+// The granularity defaults to "hour", the end of the range defaults to
+// now, and the start to a day, or a month for daily buckets, before the
+// end.
+//
+func parseStatsQuery(from string, to string, granularity string, now time.Time) (statsQuery, error) {
+
+	q := statsQuery{Granularity: granularity, To: now.UTC()}
+	if len(q.Granularity) == 0 {
+		q.Granularity = "hour"
+	}
+
+	step, ok := statsGranularities[q.Granularity]
+	if !ok {
+		return q, fmt.Errorf("Unknown granularity '%s', expected hour or day", granularity)
+	}
+
+	var err error
+	if len(to) > 0 {
+		q.To, err = parseStatsTime(to)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	q.From = q.To.Add(-24 * time.Hour)
+	if q.Granularity == "day" {
+		q.From = q.To.Add(-30 * 24 * time.Hour)
+	}
+	if len(from) > 0 {
+		q.From, err = parseStatsTime(from)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	q.From = q.From.Truncate(step)
+	q.To = q.To.Truncate(step)
+
+	if q.To.Before(q.From) {
+		return q, errors.New("The end of the range is before its start")
+	}
+	if q.To.Sub(q.From)/step >= statsMaxBuckets {
+		return q, fmt.Errorf("Too many buckets, at most %d may be requested", statsMaxBuckets)
+	}
+	return q, nil
+}
+
+//
+// recordStats counts the given verdict, for the given site, in the
+// current buckets.
+//
+// If the site is empty the verdict is only counted globally.
+//
+func recordStats(site string, v verdict, now time.Time) {
+
+	fields := []string{"ok"}
+	if v.Spam {
+		fields = []string{"spam", "blocker-" + v.Blocker.Name}
+	}
+
+	scopes := []string{"global"}
+	if len(site) > 0 {
+		scopes = append(scopes, "site-"+site)
+	}
+
+	if redisHandle != nil {
+		pipe := redisHandle.TxPipeline()
+		for granularity, step := range statsGranularities {
+			bucket := now.UTC().Truncate(step)
+			for _, scope := range scopes {
+				key := statsKey(scope, granularity, bucket)
+				for _, field := range fields {
+					pipe.HIncrBy(key, field, 1)
+				}
+				pipe.ExpireAt(key, bucket.Add(step+statsRetention(granularity)))
+			}
+		}
+		_, err := pipe.Exec()
+		if err != nil {
+			fmt.Printf("WARNING redis-error recording statistics - %s\n", err.Error())
+		}
+		return
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	//
+	// Periodically drop the buckets which have expired.
+	//
+	if now.Sub(statsSwept) >= statsSweepInterval {
+		statsSwept = now
+		for old, expires := range statsExpiry {
+			if !now.Before(expires) {
+				delete(statsBuckets, old)
+				delete(statsExpiry, old)
+			}
+		}
+	}
+
+	for granularity, step := range statsGranularities {
+		bucket := now.UTC().Truncate(step)
+		for _, scope := range scopes {
+			key := statsKey(scope, granularity, bucket)
+
+			counts, ok := statsBuckets[key]
+			if !ok {
+				counts = make(map[string]int64)
+				statsBuckets[key] = counts
+				statsExpiry[key] = bucket.Add(step + statsRetention(granularity))
+			}
+
+			for _, field := range fields {
+				counts[field]++
+			}
+		}
+	}
+}
+
+//
+// statsSeries returns the buckets of the given scope in the given range,
+// including those which are empty.
+//
+func statsSeries(scope string, q statsQuery) ([]map[string]interface{}, error) {
+
+	step := statsGranularities[q.Granularity]
+
+	var buckets []time.Time
+	for bucket := q.From; !bucket.After(q.To); bucket = bucket.Add(step) {
+		buckets = append(buckets, bucket)
+	}
+
+	//
+	// Fetch the counts of each bucket.
+	//
+	counts := make([]map[string]string, len(buckets))
+
+	if redisHandle != nil {
+		pipe := redisHandle.Pipeline()
+		cmds := make([]*redis.StringStringMapCmd, len(buckets))
+		for i, bucket := range buckets {
+			cmds[i] = pipe.HGetAll(statsKey(scope, q.Granularity, bucket))
+		}
+		_, err := pipe.Exec()
+		if err != nil {
+			return nil, err
+		}
+		for i, cmd := range cmds {
+			counts[i] = cmd.Val()
+		}
+	} else {
+		statsLock.Lock()
+		for i, bucket := range buckets {
+			counts[i] = make(map[string]string)
+			for field, count := range statsBuckets[statsKey(scope, q.Granularity, bucket)] {
+				counts[i][field] = strconv.FormatInt(count, 10)
+			}
+		}
+		statsLock.Unlock()
+	}
+
+	//
+	// Now build the series.
+	//
+	var ret []map[string]interface{}
+	for i, bucket := range buckets {
+
+		point := map[string]interface{}{
+			"time": bucket.Format(time.RFC3339),
+			"spam": int64(0),
+			"ok":   int64(0),
+		}
+		blockers := make(map[string]int64)
+
+		for field, value := range counts[i] {
+			count, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(field, "blocker-") {
+				blockers[strings.TrimPrefix(field, "blocker-")] = count
+			} else if field == "spam" || field == "ok" {
+				point[field] = count
+			}
+		}
+		point["blockers"] = blockers
+
+		ret = append(ret, point)
+	}
+	return ret, nil
+}
@@ -0,0 +1,226 @@
+//
+// Test for our time-series statistics.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// withStats clears the buckets held in memory, for the duration of a
+// test.
+//
+func withStats(t *testing.T) {
+
+	statsLock.Lock()
+	savedBuckets, savedExpiry, savedSwept := statsBuckets, statsExpiry, statsSwept
+	statsBuckets = make(map[string]map[string]int64)
+	statsExpiry = make(map[string]time.Time)
+	statsSwept = time.Time{}
+	statsLock.Unlock()
+
+	t.Cleanup(func() {
+		statsLock.Lock()
+		statsBuckets, statsExpiry, statsSwept = savedBuckets, savedExpiry, savedSwept
+		statsLock.Unlock()
+	})
+}
+
+//
+// Test parsing ranges, and granularities.
+//
+func TestParseStatsQuery(t *testing.T) {
+
+	now := time.Date(2019, 3, 1, 12, 34, 56, 0, time.UTC)
+
+	q, err := parseStatsQuery("", "", "", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if q.Granularity != "hour" ||
+		!q.From.Equal(time.Date(2019, 2, 28, 12, 0, 0, 0, time.UTC)) ||
+		!q.To.Equal(time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+
+	q, err = parseStatsQuery("2019-02-01", "2019-02-10T13:00:00+01:00", "day", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !q.From.Equal(time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)) ||
+		!q.To.Equal(time.Date(2019, 2, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+
+	q, err = parseStatsQuery("1551441600", "", "", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !q.From.Equal(time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+
+	bogus := []struct {
+		from, to, granularity string
+		err                   string
+	}{
+		{"", "", "week", "Unknown granularity"},
+		{"yesterday", "", "", "Failed to parse"},
+		{"2019-03-02", "2019-03-01", "", "before its start"},
+		{"2018-01-01", "", "hour", "Too many buckets"},
+	}
+	for _, test := range bogus {
+		_, err := parseStatsQuery(test.from, test.to, test.granularity, now)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error '%s', got %v", test.err, err)
+		}
+	}
+}
+
+//
+// Verdicts are counted in buckets, along with their blockers.
+//
+func TestStatsSeries(t *testing.T) {
+
+	withStats(t)
+
+	now := time.Date(2019, 3, 1, 12, 34, 56, 0, time.UTC)
+	spam := verdict{Spam: true, Blocker: BlogspamPlugin{Name: "35-name.js"}}
+
+	recordStats("example.com", spam, now)
+	recordStats("example.com", spam, now.Add(time.Hour))
+	recordStats("example.com", verdict{}, now.Add(time.Hour))
+	recordStats("other.com", verdict{}, now)
+
+	q, _ := parseStatsQuery("2019-03-01T11:00:00Z", "2019-03-01T13:59:59Z", "hour", now)
+	series, err := statsSeries("site-example.com", q)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := `[{"blockers":{},"ok":0,"spam":0,"time":"2019-03-01T11:00:00Z"},` +
+		`{"blockers":{"35-name.js":1},"ok":0,"spam":1,"time":"2019-03-01T12:00:00Z"},` +
+		`{"blockers":{"35-name.js":1},"ok":1,"spam":1,"time":"2019-03-01T13:00:00Z"}]`
+
+	out, _ := json.Marshal(series)
+	if string(out) != expected {
+		t.Errorf("Unexpected series: %s", out)
+	}
+
+	q, _ = parseStatsQuery("2019-03-01", "2019-03-01", "day", now)
+	series, _ = statsSeries("global", q)
+
+	out, _ = json.Marshal(series)
+	if string(out) != `[{"blockers":{"35-name.js":2},"ok":2,"spam":2,"time":"2019-03-01T00:00:00Z"}]` {
+		t.Errorf("Unexpected series: %s", out)
+	}
+
+	//
+	// Hourly buckets expire before daily ones.
+	//
+	recordStats("example.com", spam, now.Add(statsHourlyRetention+2*time.Hour))
+
+	statsLock.Lock()
+	_, hourly := statsBuckets[statsKey("global", "hour", time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC))]
+	_, daily := statsBuckets[statsKey("global", "day", time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC))]
+	statsLock.Unlock()
+
+	if hourly || !daily {
+		t.Errorf("Unexpected expiry: hourly %v, daily %v", hourly, daily)
+	}
+}
+
+//
+// The stats end-points return a series if asked.
+//
+func TestStatsHandlerSeries(t *testing.T) {
+
+	withStats(t)
+
+	recordStats("example.com", verdict{}, time.Now())
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"POST", "/stats", `{"site":"example.com","granularity":"hour"}`, http.StatusOK},
+		{"POST", "/stats", `{"site":"https://Example.com/","granularity":"hour"}`, http.StatusOK},
+		{"POST", "/stats", `{"site":"example.com","granularity":"week"}`, http.StatusBadRequest},
+		{"GET", "/global-stats?granularity=day", "", http.StatusOK},
+	}
+
+	router := newRouter()
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("Unexpected status-code for %s: %v", test.body, rr.Code)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var ret struct {
+			Granularity string
+			Series      []struct {
+				OK int64
+			}
+		}
+		err = json.Unmarshal(rr.Body.Bytes(), &ret)
+		if err != nil {
+			t.Fatalf("Failed to decode response: %s", err.Error())
+		}
+		if len(ret.Series) == 0 || ret.Series[len(ret.Series)-1].OK != 1 {
+			t.Errorf("Unexpected response: %s", rr.Body.String())
+		}
+	}
+}
+
+//
+// Without redis only the sites we know have their own buckets.
+//
+func TestStatsUnknownSites(t *testing.T) {
+
+	withStats(t)
+	withPolicyFile(t)
+	storePolicy("known.example.com", []byte(`{"min-size":10}`))
+
+	recordVerdict(context.Background(), Submission{Site: "https://Known.example.com/"}, verdict{})
+	recordVerdict(context.Background(), Submission{Site: "unknown.example.com"}, verdict{})
+
+	q, _ := parseStatsQuery("", "", "hour", time.Now())
+
+	for site, expected := range map[string]int64{"known.example.com": 1, "unknown.example.com": 0} {
+		series, err := statsSeries("site-"+site, q)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if ok := series[len(series)-1]["ok"]; ok != expected {
+			t.Errorf("Unexpected count for %s: %v", site, ok)
+		}
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	for key := range statsBuckets {
+		if strings.Contains(key, "unknown") {
+			t.Errorf("Unexpected bucket: %s", key)
+		}
+	}
+}